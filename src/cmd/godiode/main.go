@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"klockcykel.se/godiode"
+)
+
+const DEFAULT_CONF_PATH = "/etc/godiode.json"
+
+var config = godiode.DefaultConfig()
+
+var logger *godiode.Logger
+
+func printUsage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: godiode <options> send|receive|watch <dir>\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "       godiode <options> send-stream\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "       godiode <options> receive-stream [file]\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "       godiode <options> relay send|receive\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "       godiode <options> proxy send|receive\n")
+	flag.PrintDefaults()
+}
+
+func usageError(msg string) {
+	fmt.Fprintf(os.Stderr, "Error: %s\n\n", msg)
+	printUsage()
+	os.Exit(1)
+}
+
+func checkCommonArgs() {
+	if config.SignatureMode == godiode.SIGNATURE_HMAC && config.HMACSecret == "" {
+		logger.Warn("HMAC secret not set")
+	}
+	if config.Transport == godiode.TRANSPORT_UNICAST && config.UnicastAddr == "" {
+		usageError("Unicast address required for unicast transport")
+	}
+	if config.Receiver.ReorderWindow < 0 {
+		usageError("Invalid reorder window")
+	}
+	//TODO: check more args...
+}
+
+// serveMetrics exposes the metrics at /metrics of the metrics address
+func serveMetrics() error {
+	ln, err := net.Listen("tcp", config.MetricsAddr)
+	if err != nil {
+		return errors.New("Failed to listen for metrics: " + err.Error())
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", config.Metrics.Handler())
+	go http.Serve(ln, mux)
+	return nil
+}
+
+func loadConfigFile(configFilePath string) (*godiode.Config, error) {
+	jsonFile, err := os.Open(configFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer jsonFile.Close()
+
+	data, err := ioutil.ReadAll(jsonFile)
+	if err != nil {
+		return nil, err
+	}
+	fileConfig := config
+	fileConfig.Sender = config.Sender
+	fileConfig.Receiver = config.Receiver
+	err = json.Unmarshal(data, &fileConfig)
+	return &fileConfig, err
+}
+
+func main() {
+
+	confFile := DEFAULT_CONF_PATH
+	relayRoutes := ""
+	onlyMissing := ""
+	flag.StringVar(&confFile, "conf", confFile, "JSON config file")
+	flag.IntVar(&config.MaxPacketSize, "packetsize", config.MaxPacketSize, "maximum UDP payload size")
+	flag.StringVar(&config.HMACSecret, "secret", config.HMACSecret, "HMAC secret, also required for data MACs, streams, relays, proxies and missing lists in ed25519 signature mode")
+	flag.StringVar(&config.SignatureMode, "signmode", config.SignatureMode, "signature mode, hmac|ed25519")
+	flag.StringVar(&config.Sender.SigningKey, "signkey", config.Sender.SigningKey, "PEM ed25519 private key for signing (sender only)")
+	flag.StringVar(&config.Receiver.TrustStore, "truststore", config.Receiver.TrustStore, "dir of trusted PEM ed25519 public keys (receiver only)")
+	flag.IntVar(&config.DataMACSize, "datamac", config.DataMACSize, "size in bytes of the HMAC added to every data packet, 0 disables (sender only)")
+	flag.StringVar(&config.Sender.ID, "senderid", config.Sender.ID, "sender id in manifests, defaults to the hostname (sender only)")
+	flag.StringVar(&config.StateFile, "statefile", config.StateFile, "file keeping manifest sequence numbers, receiver defaults to the tmp dir")
+	flag.IntVar(&config.Receiver.MaxClockSkew, "maxskew", config.Receiver.MaxClockSkew, "max seconds between manifest timestamp and local clock, 0 disables (receiver only)")
+	flag.StringVar(&config.EncryptionKey, "enckey", config.EncryptionKey, "pre-shared key, enables AES-256-GCM encryption")
+	flag.IntVar(&config.Sender.Bw, "bw", config.Sender.Bw, "throttle bw to X Mbit/s (sender only)")
+	flag.IntVar(&config.Sender.SettleDelay, "settle", config.Sender.SettleDelay, "seconds a changed file must be left unchanged before it is sent (watch only)")
+	flag.IntVar(&config.Sender.PollInterval, "pollinterval", config.Sender.PollInterval, "seconds between directory scans (watch only)")
+	flag.StringVar(&config.Sender.Compression, "compress", config.Sender.Compression, "compress files with none|gzip, already compressed files are sent as is (sender only)")
+	flag.StringVar(&config.Sender.AfterSend, "aftersend", config.Sender.AfterSend, "keep|move|delete files after all rounds are sent (sender only)")
+	flag.StringVar(&config.Sender.SentDir, "sentdir", config.Sender.SentDir, "archive dir for sent files with -aftersend move (sender only)")
+	flag.StringVar(&config.Sender.FailedDir, "faileddir", config.Sender.FailedDir, "dir to move files that failed to send to (sender only)")
+	flag.StringVar(&config.Transport, "transport", config.Transport, "transport to use, multicast|unicast")
+	flag.StringVar(&config.MulticastAddr, "maddr", config.MulticastAddr, "multicast address")
+	flag.StringVar(&config.UnicastAddr, "uaddr", config.UnicastAddr, "unicast address, of the receiver when sending and to listen on when receiving (unicast transport only)")
+	flag.StringVar(&config.BindAddr, "baddr", config.BindAddr, "bind address")
+	flag.StringVar(&config.MetricsAddr, "metrics", config.MetricsAddr, "address of the HTTP listener exposing Prometheus metrics at /metrics, empty disables")
+	flag.StringVar(&config.NIC, "interface", config.NIC, "interface to bind to")
+	flag.BoolVar(&config.Receiver.Delete, "delete", config.Receiver.Delete, "delete files (receiver only)")
+	flag.StringVar(&config.Receiver.ReportDir, "reportdir", config.Receiver.ReportDir, "dir to write a JSON report of every manifest session to (receiver only)")
+	flag.IntVar(&config.Receiver.ReportTimeout, "reporttimeout", config.Receiver.ReportTimeout, "seconds a session must be idle before its report is written (receiver only)")
+	flag.IntVar(&config.Sender.HeartbeatInterval, "heartbeat", config.Sender.HeartbeatInterval, "seconds between heartbeats, 0 disables (watch, send-stream, relay and proxy senders only)")
+	flag.IntVar(&config.Receiver.HeartbeatTimeout, "heartbeattimeout", config.Receiver.HeartbeatTimeout, "seconds without heartbeats before a sender is reported down, 0 disables (receiver only)")
+	flag.StringVar(&config.Receiver.HeartbeatExec, "heartbeatexec", config.Receiver.HeartbeatExec, "command run with the sender id and up|down when a sender goes down or comes back (receiver only)")
+	flag.StringVar(&config.Receiver.HealthFile, "healthfile", config.Receiver.HealthFile, "file to write the JSON health status of all senders to (receiver only)")
+	flag.StringVar(&config.Receiver.Journal, "journal", config.Receiver.Journal, "file to append every received file to as a JSON line (receiver only)")
+	flag.BoolVar(&config.Receiver.SenderDirs, "senderdirs", config.Receiver.SenderDirs, "receive the files of every sender into a subdir named by its sender id (receiver only)")
+	flag.BoolVar(&config.Verbose, "verbose", config.Verbose, "verbose output, same as -loglevel info")
+	flag.StringVar(&config.LogLevel, "loglevel", config.LogLevel, "log level, debug|info|warn|error")
+	flag.StringVar(&config.LogFormat, "logformat", config.LogFormat, "log format, text|json")
+	flag.StringVar(&config.Receiver.TmpDir, "tmpdir", config.Receiver.TmpDir, "tmp dir to use (receiver only)")
+	flag.IntVar(&config.Receiver.ReorderWindow, "reorderwindow", config.Receiver.ReorderWindow, "number of packets to wait for reordered data before declaring loss (receiver only)")
+	flag.IntVar(&config.ResendCount, "resendcount", config.ResendCount, "how many times to re-transmit from the sender")
+	flag.BoolVar(&config.ResendManifest, "resendmanifest", config.ResendManifest, "resend the manifest between every file")
+	flag.IntVar(&config.FECData, "fecdata", config.FECData, "data packets per FEC block (sender only)")
+	flag.IntVar(&config.FECParity, "fecparity", config.FECParity, "repair packets per FEC block, 0 disables FEC (sender only)")
+	flag.StringVar(&config.Proxy.Listen, "proxylisten", config.Proxy.Listen, "TCP address to accept proxy connections on (proxy sender only)")
+	flag.StringVar(&config.Proxy.Upstream, "upstream", config.Proxy.Upstream, "TCP address to connect proxied streams to (proxy receiver only)")
+	flag.IntVar(&config.StreamTimeout, "streamtimeout", config.StreamTimeout, "seconds without packets before a stream is ended, idle streams send keepalives every third of it")
+	flag.StringVar(&onlyMissing, "only-missing", onlyMissing, "missing list written by a receiver, resend only the files listed (send only)")
+	flag.StringVar(&relayRoutes, "relay", relayRoutes, "comma separated relay routes port=host:port, the sender listens on port and the receiver forwards to host:port")
+	flag.Parse()
+
+	// load defaults from file
+	fileConfig, err := loadConfigFile(confFile)
+	if err != nil && confFile != DEFAULT_CONF_PATH {
+		fmt.Fprintf(os.Stderr, "Error reading config: %s\n", err)
+		os.Exit(1)
+	}
+
+	if fileConfig != nil {
+		config = *fileConfig
+	}
+
+	// override file conf with args
+	flag.Parse()
+
+	if relayRoutes != "" {
+		config.Relay, err = godiode.ParseRelayRoutes(relayRoutes)
+		if err != nil {
+			usageError(err.Error())
+		}
+	}
+
+	logger, err = godiode.NewLogger(os.Stderr, &config)
+	if err != nil {
+		usageError(err.Error())
+	}
+	config.Logger = logger
+	config.Metrics = godiode.NewMetrics()
+
+	args := flag.Args()
+	if len(args) < 1 {
+		usageError("Missing required arguments")
+	}
+	command := args[0]
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	sender, err := godiode.NewSender(&config)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	receiver, err := godiode.NewReceiver(&config)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	if config.MetricsAddr != "" {
+		err = serveMetrics()
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if onlyMissing != "" && command != "send" {
+		usageError("Missing list only supported by send")
+	}
+
+	switch command {
+	case "send", "receive", "watch":
+		if len(args) != 2 {
+			usageError("Missing required dir argument")
+		}
+		dir := args[1]
+		finfo, serr := os.Stat(dir)
+		if serr != nil {
+			usageError(serr.Error())
+		}
+		if command != "send" && !finfo.IsDir() {
+			usageError("Invalid " + command + " dir")
+		}
+		checkCommonArgs()
+		if command == "send" && onlyMissing != "" {
+			var list *godiode.MissingList
+			list, err = godiode.ReadMissingList(onlyMissing, &config)
+			if err == nil {
+				err = sender.SendMissing(ctx, dir, list)
+			}
+		} else if command == "send" {
+			err = sender.Send(ctx, dir)
+		} else if command == "receive" {
+			err = receiver.Receive(ctx, dir)
+		} else {
+			err = sender.Watch(ctx, dir)
+		}
+	case "send-stream":
+		if len(args) != 1 {
+			usageError("Unexpected arguments to send-stream")
+		}
+		checkCommonArgs()
+		err = sender.SendStream(ctx, os.Stdin)
+	case "receive-stream":
+		var out io.Writer = os.Stdout
+		if len(args) == 2 && args[1] != "-" {
+			f, err := os.OpenFile(args[1], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, config.Receiver.FilePermission)
+			if err != nil {
+				usageError("Failed to create stream output: " + err.Error())
+			}
+			defer f.Close()
+			out = f
+		} else if len(args) > 2 {
+			usageError("Unexpected arguments to receive-stream")
+		}
+		checkCommonArgs()
+		err = receiver.ReceiveStream(ctx, out)
+	case "relay":
+		if len(args) != 2 || (args[1] != "send" && args[1] != "receive") {
+			usageError("Missing required relay send|receive command")
+		}
+		checkCommonArgs()
+		if args[1] == "send" {
+			err = sender.Relay(ctx)
+		} else {
+			err = receiver.Relay(ctx)
+		}
+	case "proxy":
+		if len(args) != 2 || (args[1] != "send" && args[1] != "receive") {
+			usageError("Missing required proxy send|receive command")
+		}
+		checkCommonArgs()
+		if args[1] == "send" {
+			err = sender.Proxy(ctx)
+		} else {
+			err = receiver.Proxy(ctx)
+		}
+	default:
+		usageError("Missing required send|receive|watch|send-stream|receive-stream|relay|proxy command")
+	}
+
+	// interrupted by a signal
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+}
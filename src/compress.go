@@ -0,0 +1,178 @@
+package godiode
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/**
+ * Content encoding
+ *
+ * The filetype byte of the file transfer start packet holds the file type in
+ * the low nibble and the content encoding in the high nibble. With an encoding
+ * set, size, data and repair packets refer to the encoded stream while the
+ * checksum in the complete packet is still of the original content. Other
+ * encodings are reserved.
+ *
+ * Files are compressed up front into a tmp file rather than on the fly, as
+ * the encoded size is sent in the file transfer start packet and every round
+ * sends the same encoded stream.
+ */
+const (
+	FILE_TYPE_REGULAR = 0x00
+	FILE_TYPE_MASK    = 0x0f
+
+	ENCODING_NONE = 0x00
+	ENCODING_GZIP = 0x10
+	ENCODING_MASK = 0xf0
+)
+
+const (
+	COMPRESSION_NONE = "none"
+	COMPRESSION_GZIP = "gzip"
+)
+
+// extensions of formats that are already compressed
+var compressedExtensions = map[string]bool{
+	".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true, ".lz4": true,
+	".zip": true, ".7z": true, ".rar": true, ".jar": true,
+	".docx": true, ".xlsx": true, ".pptx": true, ".odt": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
+	".mp3": true, ".mp4": true, ".mkv": true, ".avi": true, ".mov": true, ".ogg": true,
+}
+
+func checkCompression(compression string) error {
+	switch compression {
+	case "", COMPRESSION_NONE, COMPRESSION_GZIP:
+		return nil
+	}
+	return errors.New("Invalid compression " + compression)
+}
+
+func encodingName(encoding byte) string {
+	switch encoding {
+	case ENCODING_NONE:
+		return COMPRESSION_NONE
+	case ENCODING_GZIP:
+		return COMPRESSION_GZIP
+	}
+	return "unknown"
+}
+
+// compressFile gzips f into a tmp file while hashing the original content.
+// Returns an empty name if the file is not worth compressing.
+func compressFile(conf *Config, f string, size int64, h hash.Hash) (string, error) {
+	if conf.Sender.Compression != COMPRESSION_GZIP || size == 0 {
+		return "", nil
+	}
+	if compressedExtensions[strings.ToLower(filepath.Ext(f))] {
+		return "", nil
+	}
+	in, err := os.Open(f)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := ioutil.TempFile("", "godiode.gz.")
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, io.TeeReader(in, h))
+	if err == nil {
+		err = zw.Close()
+	}
+	var info os.FileInfo
+	if err == nil {
+		info, err = out.Stat()
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", errors.New("Failed to compress " + f + ": " + err.Error())
+	}
+	if info.Size() >= size {
+		os.Remove(out.Name())
+		h.Reset()
+		return "", nil
+	}
+	return out.Name(), nil
+}
+
+// compressedFile is a file compressed once for all rounds of a session
+type compressedFile struct {
+	// tmp file with the compressed content, empty if not worth compressing
+	name string
+	// sha256 of the original content
+	hash []byte
+}
+
+// compressedFiles are the compressed files of a session by file index
+type compressedFiles map[uint32]*compressedFile
+
+// get compresses file fIndex on its first round
+func (cf compressedFiles) get(conf *Config, fIndex uint32, f string, size int64) (*compressedFile, error) {
+	c, exists := cf[fIndex]
+	if exists {
+		return c, nil
+	}
+	h := sha256.New()
+	name, err := compressFile(conf, f, size, h)
+	if err != nil {
+		return nil, err
+	}
+	c = &compressedFile{name: name, hash: h.Sum(nil)}
+	cf[fIndex] = c
+	return c, nil
+}
+
+// remove deletes the tmp files once the session is done
+func (cf compressedFiles) remove() {
+	for _, c := range cf {
+		if c.name != "" {
+			os.Remove(c.name)
+		}
+	}
+}
+
+// decodeFile decodes the received encoded stream in src to dst, hashing the
+// decoded content. Output beyond the size in the manifest is rejected.
+func decodeFile(src string, dst string, encoding byte, size int64, h hash.Hash, perm os.FileMode) error {
+	if encoding != ENCODING_GZIP {
+		return errors.New("Unsupported content encoding " + encodingName(encoding))
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	n, err := io.CopyN(io.MultiWriter(out, h), zr, size+1)
+	if err == io.EOF {
+		err = nil
+	}
+	if err == nil && n != size {
+		err = errors.New("decoded size mismatch")
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
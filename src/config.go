@@ -1,9 +1,18 @@
-package main
+package godiode
 
 import "io/fs"
 
 type SenderConfig struct {
-	Bw int `json:"bw"`
+	ID                string `json:"id"`
+	Bw                int    `json:"bw"`
+	SettleDelay       int    `json:"settleDelay"`
+	PollInterval      int    `json:"pollInterval"`
+	SigningKey        string `json:"signingKey"`
+	AfterSend         string `json:"afterSend"`
+	Compression       string `json:"compression"`
+	SentDir           string `json:"sentDir"`
+	FailedDir         string `json:"failedDir"`
+	HeartbeatInterval int    `json:"heartbeatInterval"`
 }
 
 type ReceiverConfig struct {
@@ -11,33 +20,105 @@ type ReceiverConfig struct {
 	FilePermission   fs.FileMode `json:"filePermission"`
 	FolderPermission fs.FileMode `json:"folderPermission"`
 	TmpDir           string      `json:"tmpDir"`
+	ReorderWindow    int         `json:"reorderWindow"`
+	TrustStore       string      `json:"trustStore"`
+	MaxClockSkew     int         `json:"maxClockSkew"`
+	SenderDirs       bool        `json:"senderDirs"`
+	ReportDir        string      `json:"reportDir"`
+	ReportTimeout    int         `json:"reportTimeout"`
+	Journal          string      `json:"journal"`
+	HeartbeatTimeout int         `json:"heartbeatTimeout"`
+	HeartbeatExec    string      `json:"heartbeatExec"`
+	HealthFile       string      `json:"healthFile"`
+}
+
+type ProxyConfig struct {
+	Listen   string `json:"listen"`
+	Upstream string `json:"upstream"`
 }
 
 type Config struct {
 	MaxPacketSize  int            `json:"maxPacketSize"`
 	HMACSecret     string         `json:"hmacSecret"`
+	EncryptionKey  string         `json:"encryptionKey"`
+	SignatureMode  string         `json:"signatureMode"`
+	DataMACSize    int            `json:"dataMacSize"`
+	StateFile      string         `json:"stateFile"`
+	Transport      string         `json:"transport"`
 	MulticastAddr  string         `json:"multicastAddr"`
+	UnicastAddr    string         `json:"unicastAddr"`
 	BindAddr       string         `json:"bindAddr"`
 	NIC            string         `json:"nic"`
 	Verbose        bool           `json:"verbose"`
+	LogLevel       string         `json:"logLevel"`
+	LogFormat      string         `json:"logFormat"`
 	Sender         SenderConfig   `json:"sender"`
 	Receiver       ReceiverConfig `json:"receiver"`
 	ResendCount    int            `json:"resendcount"`
 	ResendManifest bool           `json:"resendmanifest"`
+	FECData        int            `json:"fecData"`
+	FECParity      int            `json:"fecParity"`
+	Relay          []RelayRoute   `json:"relay"`
+	Proxy          ProxyConfig    `json:"proxy"`
+	StreamTimeout  int            `json:"streamTimeout"`
+	MetricsAddr    string         `json:"metricsAddr"`
+
+	// Logger to use instead of one writing to stderr with the log level and
+	// format of the config
+	Logger *Logger `json:"-"`
+	// Metrics registry to count in, shared by all senders and receivers
+	// using the config
+	Metrics *Metrics `json:"-"`
 }
 
-var config = Config{
-	MaxPacketSize: 1500 - 8 - 20,
-	HMACSecret:    "",
-	MulticastAddr: "239.252.28.12:5432",
-	BindAddr:      "",
-	NIC:           "",
-	Sender:        SenderConfig{Bw: 0},
-	Receiver: ReceiverConfig{
-		Delete:           false,
-		FilePermission:   0600,
-		FolderPermission: 0700,
-		TmpDir:           "",
-	},
-	ResendCount: 1,
+// DefaultConfig returns the default configuration
+func DefaultConfig() Config {
+	return Config{
+		MaxPacketSize: 1500 - 8 - 20,
+		HMACSecret:    "",
+		EncryptionKey: "",
+		SignatureMode: SIGNATURE_HMAC,
+		DataMACSize:   0,
+		StateFile:     "",
+		Transport:     TRANSPORT_MULTICAST,
+		MulticastAddr: "239.252.28.12:5432",
+		UnicastAddr:   "",
+		BindAddr:      "",
+		NIC:           "",
+		LogLevel:      "warn",
+		LogFormat:     LOG_FORMAT_TEXT,
+		Sender: SenderConfig{
+			ID:                "",
+			Bw:                0,
+			SettleDelay:       5,
+			PollInterval:      30,
+			SigningKey:        "",
+			AfterSend:         AFTER_SEND_KEEP,
+			Compression:       COMPRESSION_NONE,
+			SentDir:           "",
+			FailedDir:         "",
+			HeartbeatInterval: 10,
+		},
+		Receiver: ReceiverConfig{
+			Delete:           false,
+			FilePermission:   0600,
+			FolderPermission: 0700,
+			TmpDir:           "",
+			ReorderWindow:    128,
+			TrustStore:       "",
+			MaxClockSkew:     300,
+			SenderDirs:       false,
+			ReportDir:        "",
+			ReportTimeout:    30,
+			Journal:          "",
+			HeartbeatTimeout: 30,
+			HeartbeatExec:    "",
+			HealthFile:       "",
+		},
+		ResendCount:   1,
+		FECData:       32,
+		FECParity:     4,
+		StreamTimeout: 60,
+		MetricsAddr:   "",
+	}
 }
@@ -0,0 +1,129 @@
+package godiode
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const CRYPTO_OVERHEAD = 8 + 16
+
+const SALT_SIZE = 16
+
+/**
+ * Payload encryption
+ *
+ * With an encryption key configured every manifest session gets its own
+ * AES-256-GCM key, derived from the pre-shared key, the manifest id and a
+ * random salt sent with the manifest. Nonces are the manifest id followed by
+ * a per-session packet sequence number.
+ *
+ * encrypted manifest
+ * salt - byte[16] - random session salt
+ * payload - byte[] - sealed manifest, sequence number 0
+ *
+ * encrypted packet
+ * | header | seq | payload | tag |
+ * header - byte[] - packet type and manifest id, in clear text and authenticated
+ * seq - uint64 - packet sequence number within the session
+ * payload - byte[] - sealed rest of the packet
+ * tag - byte[16] - GCM authentication tag
+ */
+
+type sessionCipher struct {
+	aead       cipher.AEAD
+	manifestId uint32
+	salt       []byte
+	seq        uint64
+	buff       []byte
+}
+
+func newSessionCipher(key string, manifestId uint32, salt []byte) (*sessionCipher, error) {
+	h := sha256.New()
+	io.WriteString(h, "godiode-aes-256-gcm")
+	io.WriteString(h, key)
+	mac := hmac.New(sha256.New, h.Sum(nil))
+	binary.Write(mac, binary.BigEndian, manifestId)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionCipher{aead: aead, manifestId: manifestId, salt: salt}, nil
+}
+
+// newSenderCipher creates the cipher for a new session with a random salt
+func newSenderCipher(key string, manifestId uint32) (*sessionCipher, error) {
+	salt := make([]byte, SALT_SIZE)
+	_, err := crand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	return newSessionCipher(key, manifestId, salt)
+}
+
+// randomId returns a random manifest, stream or relay id
+func randomId() uint32 {
+	b := make([]byte, 4)
+	crand.Read(b)
+	return binary.BigEndian.Uint32(b)
+}
+
+func (sc *sessionCipher) nonce(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce, sc.manifestId)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+func (sc *sessionCipher) sealManifest(data []byte) []byte {
+	out := append([]byte{}, sc.salt...)
+	return sc.aead.Seal(out, sc.nonce(0), data, nil)
+}
+
+func openManifest(key string, manifestId uint32, data []byte) (*sessionCipher, []byte, error) {
+	if len(data) < SALT_SIZE+16 {
+		return nil, nil, errors.New("Truncated encrypted manifest")
+	}
+	sc, err := newSessionCipher(key, manifestId, data[:SALT_SIZE])
+	if err != nil {
+		return nil, nil, err
+	}
+	plain, err := sc.aead.Open(nil, sc.nonce(0), data[SALT_SIZE:], nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sc, plain, nil
+}
+
+// seal encrypts pkt[hdrLen:] into dst, keeping the header in clear text
+func (sc *sessionCipher) seal(dst []byte, pkt []byte, hdrLen int) []byte {
+	sc.seq++
+	dst = append(dst[:0], pkt[:hdrLen]...)
+	dst = append(dst, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(dst[hdrLen:], sc.seq)
+	return sc.aead.Seal(dst, sc.nonce(sc.seq), pkt[hdrLen:], pkt[:hdrLen])
+}
+
+// open decrypts a sealed packet into dst, returning the packet as it was
+// before sealing
+func (sc *sessionCipher) open(dst []byte, pkt []byte, hdrLen int) ([]byte, error) {
+	if len(pkt) < hdrLen+CRYPTO_OVERHEAD {
+		return nil, errors.New("Truncated encrypted packet")
+	}
+	seq := binary.BigEndian.Uint64(pkt[hdrLen:])
+	if seq == 0 {
+		return nil, errors.New("Invalid packet sequence number")
+	}
+	dst = append(dst[:0], pkt[:hdrLen]...)
+	return sc.aead.Open(dst, sc.nonce(seq), pkt[hdrLen+8:], pkt[:hdrLen])
+}
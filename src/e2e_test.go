@@ -0,0 +1,883 @@
+package godiode
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io/fs"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// source tree used by most tests, file contents by path relative to the root
+func testTree() map[string][]byte {
+	large := make([]byte, 3*1024*1024+17)
+	rand.New(rand.NewSource(42)).Read(large)
+	return map[string][]byte{
+		"top.txt":         []byte("top level file\n"),
+		"empty.bin":       {},
+		"a/b/c/deep.txt":  []byte("nested file\n"),
+		"a/b/sibling.txt": []byte("sibling\n"),
+		"large.bin":       large,
+		"räksmörgås/日本語 ファイル.txt": []byte("unicode name\n"),
+	}
+}
+
+var testMtime = time.Date(2020, 2, 29, 12, 34, 56, 0, time.UTC)
+
+// writeTree creates files and empty dirs below root, dirs are given with a
+// trailing slash and nil content
+func writeTree(t *testing.T, root string, files map[string][]byte) {
+	t.Helper()
+	for p, data := range files {
+		fp := filepath.Join(root, p)
+		if strings.HasSuffix(p, "/") {
+			if err := os.MkdirAll(fp, 0700); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(fp), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fp, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// set mtimes bottom up, as creating entries changes the dir mtime
+	paths := []string{}
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if p != root {
+			paths = append(paths, p)
+		}
+		return nil
+	})
+	for i := len(paths) - 1; i >= 0; i-- {
+		if err := os.Chtimes(paths[i], testMtime, testMtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type treeEntry struct {
+	dir   bool
+	data  []byte
+	mtime int64
+}
+
+func readTree(t *testing.T, root string) map[string]treeEntry {
+	t.Helper()
+	res := map[string]treeEntry{}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		if d.Name() == ".tmp" {
+			return filepath.SkipDir
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		e := treeEntry{dir: d.IsDir(), mtime: info.ModTime().Unix()}
+		if !e.dir {
+			e.data, err = os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+		}
+		res[rel] = e
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// assertTreesEqual compares the content of all files and the mtimes of files
+// and empty dirs. Other dir mtimes change when files are received into them.
+func assertTreesEqual(t *testing.T, expected string, actual string) {
+	t.Helper()
+	exp := readTree(t, expected)
+	act := readTree(t, actual)
+	for p, e := range exp {
+		a, exists := act[p]
+		if !exists {
+			t.Errorf("missing %s", p)
+			continue
+		}
+		if e.dir != a.dir {
+			t.Errorf("%s: dir %v, expected %v", p, a.dir, e.dir)
+			continue
+		}
+		if !bytes.Equal(e.data, a.data) {
+			t.Errorf("%s: content differs, %d bytes, expected %d", p, len(a.data), len(e.data))
+		}
+		empty := true
+		for q := range exp {
+			if strings.HasPrefix(q, p+string(filepath.Separator)) {
+				empty = false
+			}
+		}
+		if (!e.dir || empty) && e.mtime != a.mtime {
+			t.Errorf("%s: mtime %v, expected %v", p, time.Unix(a.mtime, 0), time.Unix(e.mtime, 0))
+		}
+	}
+	for p := range act {
+		if _, exists := exp[p]; !exists {
+			t.Errorf("unexpected %s", p)
+		}
+	}
+}
+
+func testConfig(t *testing.T) *Config {
+	conf := DefaultConfig()
+	conf.HMACSecret = "test secret"
+	// the memory network drops packets the receiver can't keep up with
+	conf.Sender.Bw = 100
+	return &conf
+}
+
+type testReceiver struct {
+	received chan FileEvent
+	failed   chan FileEvent
+	cancel   context.CancelFunc
+	done     chan error
+	stopOnce sync.Once
+}
+
+func startReceiver(t *testing.T, conf *Config, tr Transport, dir string) *testReceiver {
+	t.Helper()
+	r, err := NewReceiver(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Transport = tr
+	rr := &testReceiver{
+		received: make(chan FileEvent, 100),
+		failed:   make(chan FileEvent, 100),
+		done:     make(chan error, 1),
+	}
+	r.OnFileReceived = func(e FileEvent) { rr.received <- e }
+	r.OnFileFailed = func(e FileEvent) { rr.failed <- e }
+	var ctx context.Context
+	ctx, rr.cancel = context.WithCancel(context.Background())
+	go func() { rr.done <- r.Receive(ctx, dir) }()
+	t.Cleanup(rr.stop)
+	return rr
+}
+
+func (r *testReceiver) stop() {
+	r.stopOnce.Do(func() {
+		r.cancel()
+		<-r.done
+	})
+}
+
+// waitReceived waits for count files to be committed
+func (r *testReceiver) waitReceived(t *testing.T, count int) {
+	t.Helper()
+	timeout := time.After(20 * time.Second)
+	for i := 0; i < count; i++ {
+		select {
+		case <-r.received:
+		case <-timeout:
+			t.Fatalf("received %d of %d files", i, count)
+		}
+	}
+}
+
+func send(t *testing.T, conf *Config, tr Transport, dir string) {
+	t.Helper()
+	s, err := NewSender(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Transport = tr
+	err = s.Send(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testTransfer(t *testing.T, conf *Config, imp Impairment) {
+	src := t.TempDir()
+	dst := t.TempDir()
+	tree := testTree()
+	tree["void/"] = nil
+	writeTree(t, src, tree)
+
+	n := NewMemoryNetwork(imp)
+	r := startReceiver(t, conf, n.Listen(), dst)
+	send(t, conf, n.Dial(), src)
+	r.waitReceived(t, len(tree)-1)
+	assertTreesEqual(t, src, dst)
+}
+
+func TestSendReceive(t *testing.T) {
+	testTransfer(t, testConfig(t), Impairment{})
+}
+
+func TestSendReceiveLossy(t *testing.T) {
+	conf := testConfig(t)
+	conf.ResendCount = 3
+	testTransfer(t, conf, Impairment{Loss: 0.02, Reorder: 0.02, Duplicate: 0.02, Seed: 1})
+}
+
+func TestSendReceiveBitFlips(t *testing.T) {
+	conf := testConfig(t)
+	conf.DataMACSize = 16
+	conf.ResendCount = 3
+	testTransfer(t, conf, Impairment{BitFlip: 0.01, Seed: 2})
+}
+
+func TestSendReceiveEncrypted(t *testing.T) {
+	conf := testConfig(t)
+	conf.EncryptionKey = "test key"
+	conf.Sender.Compression = COMPRESSION_GZIP
+	testTransfer(t, conf, Impairment{})
+}
+
+// assertNothingReceived sends the test tree with sconf to a receiver using
+// rconf and checks that nothing is written
+func assertNothingReceived(t *testing.T, sconf *Config, rconf *Config) {
+	t.Helper()
+	src := t.TempDir()
+	dst := t.TempDir()
+	writeTree(t, src, testTree())
+
+	n := NewMemoryNetwork(Impairment{})
+	r := startReceiver(t, rconf, n.Listen(), dst)
+	send(t, sconf, n.Dial(), src)
+
+	select {
+	case e := <-r.received:
+		t.Fatalf("received %s", e.Path)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if files := readTree(t, dst); len(files) > 0 {
+		t.Fatalf("receive dir not empty: %v", files)
+	}
+}
+
+func TestPlaintextRejectedWithEncryption(t *testing.T) {
+	rconf := testConfig(t)
+	rconf.EncryptionKey = "test key"
+	rconf.Metrics = NewMetrics()
+	assertNothingReceived(t, testConfig(t), rconf)
+	if rconf.Metrics.authFailures[AUTH_DECRYPTION].get() == 0 {
+		t.Error("no decryption failures counted")
+	}
+}
+
+func TestWrongEncryptionKeyRejected(t *testing.T) {
+	sconf := testConfig(t)
+	sconf.EncryptionKey = "other key"
+	rconf := testConfig(t)
+	rconf.EncryptionKey = "test key"
+	rconf.Metrics = NewMetrics()
+	assertNothingReceived(t, sconf, rconf)
+	if rconf.Metrics.authFailures[AUTH_DECRYPTION].get() == 0 {
+		t.Error("no decryption failures counted")
+	}
+}
+
+func TestSendReceiveUnicast(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("no loopback: " + err.Error())
+	}
+	addr := l.LocalAddr().String()
+	l.Close()
+
+	conf := testConfig(t)
+	conf.Transport = TRANSPORT_UNICAST
+	conf.UnicastAddr = addr
+	conf.Sender.Bw = 200
+	src := t.TempDir()
+	dst := t.TempDir()
+	writeTree(t, src, map[string][]byte{
+		"a.txt":     []byte("over udp\n"),
+		"sub/b.txt": bytes.Repeat([]byte("0123456789"), 10000),
+	})
+
+	rt, err := ListenUnicast(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rt.Close() })
+	st, err := DialUnicast(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	r := startReceiver(t, conf, rt, dst)
+	send(t, conf, st, src)
+	r.waitReceived(t, 2)
+	assertTreesEqual(t, src, dst)
+}
+
+func TestWrongSecretRejected(t *testing.T) {
+	rconf := testConfig(t)
+	rconf.HMACSecret = "other secret"
+	assertNothingReceived(t, testConfig(t), rconf)
+}
+
+func TestDelete(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+	tree := map[string][]byte{
+		"keep.txt":     []byte("kept\n"),
+		"sub/new.txt":  []byte("new\n"),
+		"sub/keep.txt": []byte("kept too\n"),
+	}
+	writeTree(t, src, tree)
+	writeTree(t, dst, map[string][]byte{
+		"keep.txt":          []byte("kept\n"),
+		"stale.txt":         []byte("stale\n"),
+		"sub/keep.txt":      []byte("kept too\n"),
+		"sub/stale.txt":     []byte("stale\n"),
+		"gone/deeper/x.txt": []byte("stale\n"),
+		"gone/empty/":       nil,
+	})
+
+	conf := testConfig(t)
+	conf.Receiver.Delete = true
+	n := NewMemoryNetwork(Impairment{})
+	r := startReceiver(t, conf, n.Listen(), dst)
+	send(t, conf, n.Dial(), src)
+	r.waitReceived(t, len(tree))
+	assertTreesEqual(t, src, dst)
+}
+
+func TestDeleteSharedDir(t *testing.T) {
+	dst := t.TempDir()
+	conf := testConfig(t)
+	conf.Receiver.Delete = true
+	n := NewMemoryNetwork(Impairment{})
+	r := startReceiver(t, conf, n.Listen(), dst)
+	for _, id := range []string{"alpha", "beta"} {
+		src := t.TempDir()
+		writeTree(t, src, map[string][]byte{id + ".txt": []byte("from " + id + "\n")})
+		sconf := *conf
+		sconf.Sender.ID = id
+		send(t, &sconf, n.Dial(), src)
+		r.waitReceived(t, 1)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "alpha.txt")); err != nil {
+		t.Fatal("file of another sender deleted: " + err.Error())
+	}
+}
+
+func TestDeleteKeepsReceiverFiles(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+	writeTree(t, src, map[string][]byte{"a.txt": []byte("a\n")})
+
+	conf := testConfig(t)
+	conf.Receiver.Delete = true
+	conf.Receiver.ReportDir = filepath.Join(dst, "reports")
+	conf.Receiver.Journal = filepath.Join(dst, "logs", "journal.log")
+	if err := os.MkdirAll(filepath.Dir(conf.Receiver.Journal), 0700); err != nil {
+		t.Fatal(err)
+	}
+	n := NewMemoryNetwork(Impairment{})
+	r := startReceiver(t, conf, n.Listen(), dst)
+	send(t, conf, n.Dial(), src)
+	r.waitReceived(t, 1)
+	send(t, conf, n.Dial(), src)
+	time.Sleep(200 * time.Millisecond)
+	for _, p := range []string{conf.Receiver.ReportDir, conf.Receiver.Journal} {
+		if _, err := os.Stat(p); err != nil {
+			t.Error("receiver file deleted: " + err.Error())
+		}
+	}
+}
+
+func TestNoDelete(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+	writeTree(t, src, map[string][]byte{"new.txt": []byte("new\n")})
+	writeTree(t, dst, map[string][]byte{"old/old.txt": []byte("old\n")})
+
+	conf := testConfig(t)
+	n := NewMemoryNetwork(Impairment{})
+	r := startReceiver(t, conf, n.Listen(), dst)
+	send(t, conf, n.Dial(), src)
+	r.waitReceived(t, 1)
+	if _, err := os.Stat(filepath.Join(dst, "old", "old.txt")); err != nil {
+		t.Fatal("file deleted without delete enabled: " + err.Error())
+	}
+}
+
+func TestConcurrentSenders(t *testing.T) {
+	dst := t.TempDir()
+	n := NewMemoryNetwork(Impairment{Loss: 0.01, Seed: 3})
+	rconf := testConfig(t)
+	rconf.Receiver.SenderDirs = true
+	r := startReceiver(t, rconf, n.Listen(), dst)
+
+	senders := []string{"alpha", "beta", "gamma"}
+	srcs := map[string]string{}
+	var wg sync.WaitGroup
+	for _, id := range senders {
+		src := t.TempDir()
+		tree := testTree()
+		tree[id+".txt"] = []byte("from " + id + "\n")
+		writeTree(t, src, tree)
+		srcs[id] = src
+
+		conf := testConfig(t)
+		conf.Sender.ID = id
+		conf.ResendCount = 3
+		s, err := NewSender(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Transport = n.Dial()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Send(context.Background(), src); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	r.waitReceived(t, len(senders)*(len(testTree())+1))
+	for _, id := range senders {
+		assertTreesEqual(t, srcs[id], filepath.Join(dst, id))
+	}
+}
+
+func TestOverlappingSends(t *testing.T) {
+	dst := t.TempDir()
+	n := NewMemoryNetwork(Impairment{})
+	conf := testConfig(t)
+	r := startReceiver(t, conf, n.Listen(), dst)
+
+	first := t.TempDir()
+	second := t.TempDir()
+	writeTree(t, first, testTree())
+	writeTree(t, second, map[string][]byte{"second.txt": []byte("second\n")})
+	// the first send takes at least two rounds of one second
+	fconf := *conf
+	fconf.ResendCount = 2
+	s, err := NewSender(&fconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Transport = n.Dial()
+	done := make(chan error)
+	go func() { done <- s.Send(context.Background(), first) }()
+	time.Sleep(1500 * time.Millisecond)
+	send(t, conf, n.Dial(), second)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	r.waitReceived(t, len(testTree())+1)
+	writeTree(t, first, map[string][]byte{"second.txt": []byte("second\n")})
+	assertTreesEqual(t, first, dst)
+}
+
+// gatedTransport drops all packets written until open is closed
+type gatedTransport struct {
+	Transport
+	open chan struct{}
+}
+
+func (g *gatedTransport) WritePacket(pkt []byte) error {
+	select {
+	case <-g.open:
+		return g.Transport.WritePacket(pkt)
+	default:
+		return nil
+	}
+}
+
+func TestInterleavedSendsOfOneSender(t *testing.T) {
+	dst := t.TempDir()
+	n := NewMemoryNetwork(Impairment{})
+	conf := testConfig(t)
+	conf.Sender.ID = "shared"
+	r := startReceiver(t, conf, n.Listen(), dst)
+
+	first := t.TempDir()
+	second := t.TempDir()
+	writeTree(t, first, testTree())
+	writeTree(t, second, map[string][]byte{"second.txt": []byte("second\n")})
+	// the first round of the first send is lost, its manifest arrives again
+	// in later rounds, after the manifest of the second send
+	fconf := *conf
+	fconf.ResendCount = 3
+	fconf.ResendManifest = true
+	s, err := NewSender(&fconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gate := &gatedTransport{n.Dial(), make(chan struct{})}
+	s.Transport = gate
+	done := make(chan error)
+	go func() { done <- s.Send(context.Background(), first) }()
+	time.Sleep(200 * time.Millisecond)
+	send(t, conf, n.Dial(), second)
+	r.waitReceived(t, 1)
+	close(gate.open)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	r.waitReceived(t, len(testTree()))
+	writeTree(t, first, map[string][]byte{"second.txt": []byte("second\n")})
+	assertTreesEqual(t, first, dst)
+}
+
+func TestSendReceiveFEC(t *testing.T) {
+	conf := testConfig(t)
+	conf.FECData = 8
+	conf.FECParity = 2
+	conf.ResendCount = 2
+	testTransfer(t, conf, Impairment{Loss: 0.02, Reorder: 0.02, Seed: 3})
+}
+
+func TestRepairsExpire(t *testing.T) {
+	conf := testConfig(t)
+	fec, err := newFecCodec(4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const chunkSize = 16
+	pt := &PendingFileTransfer{size: 100 * chunkSize, chunkSize: chunkSize, packets: 100, received: make([]uint64, 2), fec: fec, repairs: map[uint64][][]byte{}, window: make([]reorderSlot, 8)}
+	s := &fileSession{conf: conf, manifestId: 1, pendingFileTransfer: pt}
+	pkt := make([]byte, REPAIR_HEADER_SIZE+chunkSize)
+	pkt[0] = 0x04
+	binary.BigEndian.PutUint32(pkt[1:], 1)
+	// one shard of every block, none can be recovered
+	for b := 0; b < 25; b++ {
+		binary.BigEndian.PutUint32(pkt[9:], uint32(b))
+		err = s.onFileTransferRepair(pkt, len(pkt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pt.repairs) > 3 {
+			t.Fatalf("%d blocks of repairs kept", len(pt.repairs))
+		}
+	}
+	if pt.repairs[24] == nil {
+		t.Error("dropped repairs within the reorder window")
+	}
+}
+
+func TestWatchRetriesFailedFiles(t *testing.T) {
+	conf := testConfig(t)
+	conf.ResendCount = 1
+	conf.Sender.SettleDelay = 0
+	conf.Sender.PollInterval = 1
+	src := t.TempDir()
+	dst := t.TempDir()
+	writeTree(t, src, map[string][]byte{"a.txt": []byte("a\n"), "b.txt": []byte("b\n")})
+	b := filepath.Join(src, "b.txt")
+	hidden := filepath.Join(t.TempDir(), "b.txt")
+
+	n := NewMemoryNetwork(Impairment{})
+	r := startReceiver(t, conf, n.Listen(), dst)
+	s, err := NewSender(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Transport = n.Dial()
+	// b.txt fails once and is back unchanged after the session
+	failed := false
+	s.OnFileSent = func(e FileEvent) {
+		if e.Path == "a.txt" && !failed {
+			os.Rename(b, hidden)
+		}
+	}
+	s.OnFileFailed = func(e FileEvent) {
+		failed = true
+		os.Rename(hidden, b)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Watch(ctx, src) }()
+	r.waitReceived(t, 2)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatal(err)
+	}
+	if !failed {
+		t.Fatal("b.txt did not fail")
+	}
+	assertTreesEqual(t, src, dst)
+}
+
+func TestWatchDeleteKeepsUnsettledFiles(t *testing.T) {
+	conf := testConfig(t)
+	conf.Receiver.Delete = true
+	conf.Sender.SettleDelay = 2
+	conf.Sender.PollInterval = 1
+	src := t.TempDir()
+	dst := t.TempDir()
+	writeTree(t, src, map[string][]byte{"a.txt": []byte("a\n"), "b.txt": []byte("b\n")})
+	b := filepath.Join(src, "b.txt")
+
+	n := NewMemoryNetwork(Impairment{})
+	r := startReceiver(t, conf, n.Listen(), dst)
+	s, err := NewSender(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Transport = n.Dial()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Watch(ctx, src) }()
+	r.waitReceived(t, 2)
+
+	// b.txt keeps growing and never settles while c.txt is sent
+	stop := make(chan struct{})
+	growing := make(chan struct{})
+	go func() {
+		defer close(growing)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(300 * time.Millisecond):
+			}
+			f, err := os.OpenFile(b, os.O_APPEND|os.O_WRONLY, 0600)
+			if err == nil {
+				f.Write([]byte("b\n"))
+				f.Close()
+			}
+		}
+	}()
+	writeTree(t, src, map[string][]byte{"c.txt": []byte("c\n")})
+	select {
+	case e := <-r.received:
+		if e.Path != "c.txt" {
+			t.Fatalf("received %s before it settled", e.Path)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("c.txt not received")
+	}
+	if data, err := os.ReadFile(filepath.Join(dst, "b.txt")); err != nil || string(data) != "b\n" {
+		t.Fatalf("unsettled b.txt not kept: %q, %v", data, err)
+	}
+
+	close(stop)
+	<-growing
+	r.waitReceived(t, 1)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatal(err)
+	}
+	assertTreesEqual(t, src, dst)
+}
+
+func TestSendReceiveCompressedLossy(t *testing.T) {
+	conf := testConfig(t)
+	conf.ResendCount = 3
+	conf.Sender.Compression = COMPRESSION_GZIP
+	testTransfer(t, conf, Impairment{Loss: 0.02, Reorder: 0.02, Seed: 4})
+}
+
+func TestCompressOncePerSession(t *testing.T) {
+	conf := testConfig(t)
+	conf.Sender.Compression = COMPRESSION_GZIP
+	f := filepath.Join(t.TempDir(), "a.txt")
+	data := bytes.Repeat([]byte("compressible "), 1000)
+	if err := os.WriteFile(f, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	compressed := compressedFiles{}
+	first, err := compressed.get(conf, 0, f, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.name == "" {
+		t.Fatal("file not compressed")
+	}
+	again, err := compressed.get(conf, 0, f, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != first {
+		t.Error("file compressed again")
+	}
+	compressed.remove()
+	if _, err := os.Stat(first.name); err == nil {
+		t.Error("compressed file kept after the session")
+	}
+}
+
+func TestMemoryNetworkNoBackpressure(t *testing.T) {
+	n := NewMemoryNetwork(Impairment{})
+	l := n.Listen()
+	w := n.Dial()
+	done := make(chan struct{})
+	go func() {
+		// nobody reads the listener
+		for i := 0; i < MEMORY_QUEUE_PACKETS+10; i++ {
+			w.WritePacket([]byte{byte(i)})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writer blocked by a full listener")
+	}
+	if n.Lost() != 10 {
+		t.Errorf("lost %d packets, expected 10", n.Lost())
+	}
+	buff := make([]byte, 1)
+	if _, err := l.ReadPacket(buff); err != nil || buff[0] != 0 {
+		t.Errorf("read %v, %v", buff, err)
+	}
+}
+
+func TestMemoryNetworkReorder(t *testing.T) {
+	n := NewMemoryNetwork(Impairment{Reorder: 1})
+	l := n.Listen()
+	w := n.Dial()
+	buff := make([]byte, 1)
+	read := func() byte {
+		t.Helper()
+		l.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := l.ReadPacket(buff); err != nil {
+			t.Fatal(err)
+		}
+		return buff[0]
+	}
+	w.WritePacket([]byte{1})
+	w.WritePacket([]byte{2})
+	if first, second := read(), read(); first != 2 || second != 1 {
+		t.Errorf("read %d, %d, expected 2, 1", first, second)
+	}
+	// the last packet is held until no packet follows
+	w.WritePacket([]byte{3})
+	if last := read(); last != 3 {
+		t.Errorf("read %d, expected 3", last)
+	}
+	if n.Lost() != 0 {
+		t.Errorf("lost %d packets", n.Lost())
+	}
+}
+
+func TestInvalidReceiverConfig(t *testing.T) {
+	for _, invalid := range []func(*Config){
+		func(c *Config) { c.Receiver.ReorderWindow = -1 },
+		func(c *Config) { c.MaxPacketSize = PROTOCOL_HEADER_SIZE },
+	} {
+		conf := testConfig(t)
+		conf.Proxy.Upstream = "127.0.0.1:1"
+		invalid(conf)
+		r, err := NewReceiver(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Transport = NewMemoryNetwork(Impairment{}).Listen()
+		ctx := context.Background()
+		if err := r.Receive(ctx, t.TempDir()); err == nil {
+			t.Error("received files with an invalid config")
+		}
+		if err := r.ReceiveStream(ctx, &bytes.Buffer{}); err == nil {
+			t.Error("received stream with an invalid config")
+		}
+		if err := r.Proxy(ctx); err == nil {
+			t.Error("proxied with an invalid config")
+		}
+	}
+}
+
+// dataLossTransport drops file data packets by their offset, as many times as
+// given for the offset
+type dataLossTransport struct {
+	Transport
+	lock  sync.Mutex
+	drops map[uint64]int
+}
+
+func (d *dataLossTransport) WritePacket(pkt []byte) error {
+	if len(pkt) >= PROTOCOL_HEADER_SIZE+DATA_HEADER_SIZE && pkt[PROTOCOL_HEADER_SIZE] == 0x80 {
+		offset := binary.BigEndian.Uint64(pkt[PROTOCOL_HEADER_SIZE+9:])
+		d.lock.Lock()
+		drop := d.drops[offset] > 0
+		d.drops[offset]--
+		d.lock.Unlock()
+		if drop {
+			return nil
+		}
+	}
+	return d.Transport.WritePacket(pkt)
+}
+
+func TestLossCounters(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		configure func(*Config)
+		// times data packets are dropped, by packet index
+		drops     map[uint64]int
+		dropped   float64
+		recovered float64
+	}{
+		// lost again in the second round, received in the third
+		{"resent", func(c *Config) { c.FECParity = 0; c.ResendCount = 3 }, map[uint64]int{10: 2, 11: 1, 50: 1}, 3, 0},
+		// declared lost before the repairs of their block arrive
+		{"fec", func(c *Config) { c.FECData = 8; c.FECParity = 2; c.Receiver.ReorderWindow = 2 }, map[uint64]int{10: 1, 11: 1, 50: 1}, 0, 3},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			conf := testConfig(t)
+			c.configure(conf)
+			conf.LogLevel = "info"
+			conf.LogFormat = LOG_FORMAT_JSON
+			var buff bytes.Buffer
+			l, err := NewLogger(&buff, conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conf.Logger = l
+			chunkSize := uint64(maxPayload(conf) - DATA_HEADER_SIZE)
+			src := t.TempDir()
+			writeTree(t, src, map[string][]byte{"a.bin": bytes.Repeat([]byte{7}, int(100*chunkSize+5))})
+			drops := map[uint64]int{}
+			for n, times := range c.drops {
+				drops[n*chunkSize] = times
+			}
+
+			n := NewMemoryNetwork(Impairment{})
+			r := startReceiver(t, conf, n.Listen(), t.TempDir())
+			send(t, conf, &dataLossTransport{Transport: n.Dial(), drops: drops}, src)
+			r.waitReceived(t, 1)
+			r.stop()
+
+			var event map[string]interface{}
+			for _, line := range strings.Split(strings.TrimSpace(buff.String()), "\n") {
+				if strings.Contains(line, `"msg":"Received file"`) {
+					if err := json.Unmarshal([]byte(line), &event); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if event == nil {
+				t.Fatal("no received file event")
+			}
+			for name, value := range map[string]float64{"dropped": c.dropped, "recovered": c.recovered, "reordered": 0} {
+				if event[name] != value {
+					t.Errorf("%s is %v, expected %v", name, event[name], value)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package godiode
+
+import (
+	"errors"
+	"strconv"
+)
+
+/**
+ * Forward error correction
+ *
+ * Systematic Reed-Solomon erasure code over GF(2^8). File data packets are
+ * grouped in blocks of k data shards, and for every block m repair shards are
+ * computed using a Cauchy matrix. Any k of the k+m shards of a block are
+ * enough to reconstruct the original data.
+ */
+
+var gfExp [512]byte
+var gfLog [256]byte
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// dst ^= c * src
+func gfMulAdd(dst []byte, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	var mt [256]byte
+	for i := 1; i < 256; i++ {
+		mt[i] = gfMul(c, byte(i))
+	}
+	for i := range src {
+		dst[i] ^= mt[src[i]]
+	}
+}
+
+type fecCodec struct {
+	k int
+	m int
+}
+
+func newFecCodec(k int, m int) (*fecCodec, error) {
+	if k < 1 || k > 128 {
+		return nil, errors.New("FEC data shards must be between 1 and 128")
+	}
+	if m < 1 || k+m > 256 {
+		return nil, errors.New("FEC repair shards must be between 1 and " + strconv.Itoa(256-k))
+	}
+	return &fecCodec{k, m}, nil
+}
+
+// coefficient of data shard i in repair shard j
+func (c *fecCodec) coef(j int, i int) byte {
+	return gfInv(byte(c.k+j) ^ byte(i))
+}
+
+// encode computes repair shard j of the data shards into out
+func (c *fecCodec) encode(data [][]byte, j int, out []byte) {
+	for i := range out {
+		out[i] = 0
+	}
+	for i := range data {
+		gfMulAdd(out, data[i], c.coef(j, i))
+	}
+}
+
+// reconstruct fills in the missing (nil) data shards using the available
+// repair shards. All shards must be of equal size.
+func (c *fecCodec) reconstruct(data [][]byte, repair [][]byte) error {
+	missing := make([]int, 0, c.m)
+	size := 0
+	for i := range data {
+		if data[i] == nil {
+			missing = append(missing, i)
+		} else {
+			size = len(data[i])
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	rows := make([]int, 0, len(missing))
+	for j := range repair {
+		if repair[j] != nil && len(rows) < len(missing) {
+			rows = append(rows, j)
+			size = len(repair[j])
+		}
+	}
+	if len(rows) < len(missing) {
+		return errors.New("Not enough repair shards, missing " + strconv.Itoa(len(missing)) + " got " + strconv.Itoa(len(rows)))
+	}
+
+	// syndromes: repair shards with the contribution of the known data removed
+	e := len(missing)
+	s := make([][]byte, e)
+	for r, j := range rows {
+		s[r] = make([]byte, size)
+		copy(s[r], repair[j])
+		for i := range data {
+			if data[i] != nil {
+				gfMulAdd(s[r], data[i], c.coef(j, i))
+			}
+		}
+	}
+
+	// invert the e x e cauchy sub matrix with gauss-jordan elimination
+	a := make([][]byte, e)
+	inv := make([][]byte, e)
+	for r := 0; r < e; r++ {
+		a[r] = make([]byte, e)
+		inv[r] = make([]byte, e)
+		inv[r][r] = 1
+		for col := 0; col < e; col++ {
+			a[r][col] = c.coef(rows[r], missing[col])
+		}
+	}
+	for col := 0; col < e; col++ {
+		p := col
+		for p < e && a[p][col] == 0 {
+			p++
+		}
+		if p == e {
+			return errors.New("Singular FEC matrix")
+		}
+		a[col], a[p] = a[p], a[col]
+		inv[col], inv[p] = inv[p], inv[col]
+		f := gfInv(a[col][col])
+		for x := 0; x < e; x++ {
+			a[col][x] = gfMul(a[col][x], f)
+			inv[col][x] = gfMul(inv[col][x], f)
+		}
+		for r := 0; r < e; r++ {
+			if r == col || a[r][col] == 0 {
+				continue
+			}
+			f = a[r][col]
+			for x := 0; x < e; x++ {
+				a[r][x] ^= gfMul(a[col][x], f)
+				inv[r][x] ^= gfMul(inv[col][x], f)
+			}
+		}
+	}
+
+	for col, i := range missing {
+		d := make([]byte, size)
+		for r := 0; r < e; r++ {
+			gfMulAdd(d, s[r], inv[col][r])
+		}
+		data[i] = d
+	}
+	return nil
+}
@@ -1,3 +1,3 @@
 module klockcykel.se/godiode
 
-go 1.17
+go 1.18
@@ -0,0 +1,136 @@
+// Package godiode implements one-way file transfers, streams, datagram relaying
+// and TCP proxying over a data diode, using UDP multicast or unicast.
+package godiode
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// FileEvent describes a file sent or received
+type FileEvent struct {
+	// Sender is the id of the sending system
+	Sender string
+	// Path of the file relative to the transferred dir
+	Path string
+	// Size of the file content in bytes
+	Size int64
+	// Err is the reason a transfer failed
+	Err error
+}
+
+// Sender transmits files, streams and datagrams. Every method blocks until
+// done or the context is cancelled.
+type Sender struct {
+	conf    *Config
+	log     *Logger
+	metrics *Metrics
+
+	// Transport to send packets with instead of the one configured, it is
+	// not closed by the sender
+	Transport Transport
+
+	// OnFileSent is called for every file sent in a round
+	OnFileSent func(FileEvent)
+	// OnFileFailed is called for every file that could not be sent in a round
+	OnFileFailed func(FileEvent)
+}
+
+// NewSender creates a sender using conf, which must not be modified while the
+// sender is in use
+func NewSender(conf *Config) (*Sender, error) {
+	if conf == nil {
+		return nil, errors.New("Missing config")
+	}
+	log, err := configLogger(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &Sender{conf: conf, log: log, metrics: configMetrics(conf)}, nil
+}
+
+// Receiver receives files, streams and datagrams. Every method blocks until
+// the context is cancelled, or for streams until the end of the stream.
+type Receiver struct {
+	conf    *Config
+	log     *Logger
+	metrics *Metrics
+
+	// Transport to receive packets with instead of the one configured, it is
+	// not closed by the receiver
+	Transport Transport
+
+	// OnFileReceived is called for every file received and committed. It may
+	// be called from another goroutine than the one running Receive.
+	OnFileReceived func(FileEvent)
+	// OnFileFailed is called for every file transfer that failed. Incomplete
+	// files are kept and may be received in a later round.
+	OnFileFailed func(FileEvent)
+}
+
+// NewReceiver creates a receiver using conf, which must not be modified while
+// the receiver is in use
+func NewReceiver(conf *Config) (*Receiver, error) {
+	if conf == nil {
+		return nil, errors.New("Missing config")
+	}
+	log, err := configLogger(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &Receiver{conf: conf, log: log, metrics: configMetrics(conf)}, nil
+}
+
+func (s *Sender) transport() (Transport, error) {
+	if s.Transport != nil {
+		return borrowedTransport{s.Transport}, nil
+	}
+	return dialTransport(s.conf)
+}
+
+func (r *Receiver) listen() (Transport, error) {
+	if maxPayload(r.conf) < 1 {
+		return nil, errors.New("Too small packet max size for receiving")
+	}
+	if r.conf.Receiver.ReorderWindow < 0 {
+		return nil, errors.New("Invalid reorder window")
+	}
+	if r.Transport != nil {
+		return borrowedTransport{r.Transport}, nil
+	}
+	return listenTransport(r.conf, r.log)
+}
+
+// closeOnDone closes c when ctx is done, to interrupt blocking reads and
+// writes. The returned func stops watching ctx.
+func closeOnDone(ctx context.Context, c io.Closer) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+	}
+}
+
+// interruptOnDone interrupts blocking reads of t when ctx is done, leaving t
+// open. The returned func stops watching ctx.
+func interruptOnDone(ctx context.Context, t Transport) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			t.SetReadDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+	}
+}
@@ -0,0 +1,364 @@
+package godiode
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"os/exec"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const HEARTBEAT_HEADER_SIZE = 1 + 4 + 8 + 4
+
+const (
+	SENDER_STATUS_UP   = "up"
+	SENDER_STATUS_DOWN = "down"
+)
+
+// the health file is rewritten at least this often, so its update time shows
+// the receiver is alive
+const HEALTH_FILE_INTERVAL = 10 * time.Second
+
+/**
+ * Heartbeats
+ *
+ * Long running senders, watch, stream, relay and proxy, send a heartbeat
+ * every heartbeat interval, so the receiver can tell a broken link from an
+ * idle sender. The receiver reports a sender down when no heartbeat was
+ * received for the heartbeat timeout, and up again on the next heartbeat.
+ * Heartbeats are signed like manifests, and with an encryption key configured
+ * sealed like relay packets, see stream.go. Plain heartbeats are rejected
+ * then. The last timestamp of every sender is kept in the receiver state
+ * file; without one, heartbeats stamped before the receiver started are
+ * rejected.
+ *
+ * heartbeat packet
+ *
+ * type - uint8 - 0x00
+ * heartbeatId - uint32 - random id of the heartbeat sender
+ * timestamp - int64 - unix millis by the sender clock, increasing
+ * queue - uint32 - items waiting to be sent, changed files not sent yet in
+ *   watch mode, open connections in proxy mode, 0 for streams and relays
+ * senderIdLen - uint8
+ * senderId - byte[senderIdLen] - sender id, as in manifests
+ * versionLen - uint8
+ * version - byte[versionLen] - godiode version of the sender
+ * sign - byte[] - hmac512 or ed25519 signature of this packet
+ *
+ * encrypted heartbeat packet
+ *
+ * | type | heartbeatId | salt | seq | sealed rest of the packet | tag |
+ */
+
+// buildVersion returns the module version godiode was built from
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Path == "klockcykel.se/godiode" {
+		return info.Main.Version
+	}
+	for _, d := range info.Deps {
+		if d.Path == "klockcykel.se/godiode" {
+			return d.Version
+		}
+	}
+	return "unknown"
+}
+
+func heartbeatPacket(sig signer, id uint32, senderId string, version string, timestamp int64, queue uint32) []byte {
+	pkt := make([]byte, HEARTBEAT_HEADER_SIZE, HEARTBEAT_HEADER_SIZE+2+len(senderId)+len(version)+sig.size())
+	pkt[0] = 0x00
+	binary.BigEndian.PutUint32(pkt[1:], id)
+	binary.BigEndian.PutUint64(pkt[5:], uint64(timestamp))
+	binary.BigEndian.PutUint32(pkt[13:], queue)
+	pkt = append(pkt, byte(len(senderId)))
+	pkt = append(pkt, senderId...)
+	pkt = append(pkt, byte(len(version)))
+	pkt = append(pkt, version...)
+	return append(pkt, sig.sign(pkt)...)
+}
+
+// startHeartbeats sends a heartbeat every heartbeat interval until the
+// returned func is called, reporting the queue depth returned by queue
+func (s *Sender) startHeartbeats(c *senderConn, queue func() uint64) (func(), error) {
+	conf := s.conf
+	if conf.Sender.HeartbeatInterval < 0 {
+		return nil, errors.New("Invalid heartbeat interval")
+	}
+	if conf.Sender.HeartbeatInterval == 0 {
+		return func() {}, nil
+	}
+	sig, err := newSigner(conf)
+	if err != nil {
+		return nil, err
+	}
+	id, err := s.senderId()
+	if err != nil {
+		return nil, err
+	}
+	version := buildVersion()
+	if len(id) > 255 || len(version) > 255 {
+		return nil, errors.New("Too long sender id for heartbeats")
+	}
+	size := HEARTBEAT_HEADER_SIZE + 2 + len(id) + len(version) + sig.size()
+	hbId := randomId()
+	var sc *sessionCipher
+	if conf.EncryptionKey != "" {
+		sc, err = newSenderCipher(conf.EncryptionKey, hbId)
+		if err != nil {
+			return nil, err
+		}
+		size += SALT_SIZE + CRYPTO_OVERHEAD
+	}
+	if size > maxPayload(conf) {
+		return nil, errors.New("Too small packet max size for heartbeats")
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(time.Duration(conf.Sender.HeartbeatInterval) * time.Second)
+		defer t.Stop()
+		for {
+			q := queue()
+			if q > 0xFFFFFFFF {
+				q = 0xFFFFFFFF
+			}
+			pkt := heartbeatPacket(sig, hbId, id, version, time.Now().UnixNano()/int64(time.Millisecond), uint32(q))
+			if sc != nil {
+				pkt = sealSalted(sc, nil, pkt)
+			}
+			c.throttle(len(pkt) + HEADER_OVERHEAD)
+			err := c.WritePacket(pkt)
+			if err != nil {
+				s.log.Warn("Failed to send heartbeat", "err", err)
+			} else {
+				s.log.Debug("Sent heartbeat", "sender", id, "queue", q)
+			}
+			select {
+			case <-t.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}, nil
+}
+
+type senderHealth struct {
+	Sender  string `json:"sender"`
+	Status  string `json:"status"`
+	Version string `json:"version"`
+	Queue   uint32 `json:"queue"`
+	// time of the last heartbeat, by the sender clock
+	Timestamp  time.Time `json:"timestamp"`
+	LastSeen   time.Time `json:"lastSeen"`
+	Heartbeats uint64    `json:"heartbeats"`
+}
+
+type healthStatus struct {
+	Updated time.Time      `json:"updated"`
+	Senders []senderHealth `json:"senders"`
+}
+
+// healthMonitor tracks the heartbeats of all senders, updated by the receive
+// loop and checked for senders gone silent by its own goroutine
+type healthMonitor struct {
+	conf     *Config
+	log      *Logger
+	metrics  *Metrics
+	verifier verifier
+	replay   *replayGuard
+	// heartbeats stamped before are rejected without persisted timestamps
+	started time.Time
+	lock    sync.Mutex
+	senders map[string]*senderHealth
+	written time.Time
+	dirty   bool
+}
+
+// openHeartbeat decrypts a sealed heartbeat
+func openHeartbeat(key string, buff []byte) ([]byte, error) {
+	if len(buff) < 5+SALT_SIZE {
+		return nil, errors.New("Received truncated encrypted heartbeat")
+	}
+	sc, err := newSessionCipher(key, binary.BigEndian.Uint32(buff[1:]), append([]byte{}, buff[5:5+SALT_SIZE]...))
+	if err != nil {
+		return nil, err
+	}
+	sealed := append(append([]byte{}, buff[:5]...), buff[5+SALT_SIZE:]...)
+	plain, err := sc.open(nil, sealed, 5)
+	if err != nil {
+		return nil, errors.New("Heartbeat failing decryption: " + err.Error())
+	}
+	return plain, nil
+}
+
+func (h *healthMonitor) onHeartbeat(buff []byte) error {
+	conf := h.conf
+	if conf.EncryptionKey != "" {
+		var err error
+		buff, err = openHeartbeat(conf.EncryptionKey, buff)
+		if err != nil {
+			h.metrics.authFailed(AUTH_DECRYPTION)
+			return err
+		}
+	}
+	size := h.verifier.size()
+	if len(buff) < HEARTBEAT_HEADER_SIZE+2+size {
+		return errors.New("Received truncated heartbeat")
+	}
+	err := h.verifier.verify(buff[:len(buff)-size], buff[len(buff)-size:])
+	if err != nil {
+		return errors.New("Invalid heartbeat signature: " + err.Error())
+	}
+	ts := int64(binary.BigEndian.Uint64(buff[5:]))
+	queue := binary.BigEndian.Uint32(buff[13:])
+	payload := buff[HEARTBEAT_HEADER_SIZE : len(buff)-size]
+	idLen := int(payload[0])
+	if len(payload) < 2+idLen || len(payload) != 2+idLen+int(payload[1+idLen]) {
+		return errors.New("Received malformed heartbeat")
+	}
+	id := string(payload[1 : 1+idLen])
+	version := string(payload[2+idLen:])
+
+	skew := time.Since(time.Unix(0, ts*int64(time.Millisecond)))
+	if conf.Receiver.MaxClockSkew > 0 && (skew > time.Duration(conf.Receiver.MaxClockSkew)*time.Second || -skew > time.Duration(conf.Receiver.MaxClockSkew)*time.Second) {
+		return fieldErr("Heartbeat timestamp off by more than the max clock skew", "sender", id, "skew", skew.Round(time.Second).String())
+	}
+
+	if h.replay.stateFile == "" && ts < h.started.UnixNano()/int64(time.Millisecond) {
+		return fieldErr("Heartbeat sent before the receiver started", "sender", id)
+	}
+	err = h.replay.acceptHeartbeat(id, ts)
+	if err != nil {
+		return err
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	s := h.senders[id]
+	if s == nil {
+		s = &senderHealth{Sender: id, Status: SENDER_STATUS_UP}
+		h.senders[id] = s
+		h.log.Info("Receiving heartbeats", "sender", id, "version", version)
+	} else if s.Status == SENDER_STATUS_DOWN {
+		s.Status = SENDER_STATUS_UP
+		h.log.Warn("Heartbeats resumed", "sender", id, "down", time.Since(s.LastSeen).Round(time.Second).String())
+		h.runHook(*s)
+	}
+	s.Version = version
+	s.Queue = queue
+	s.Timestamp = time.Unix(0, ts*int64(time.Millisecond))
+	s.LastSeen = time.Now()
+	s.Heartbeats++
+	h.dirty = true
+	return nil
+}
+
+// check reports the senders without heartbeats for the heartbeat timeout as
+// down and writes the health file
+func (h *healthMonitor) check() {
+	conf := h.conf
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	timeout := time.Duration(conf.Receiver.HeartbeatTimeout) * time.Second
+	for _, s := range h.senders {
+		if s.Status == SENDER_STATUS_UP && time.Since(s.LastSeen) > timeout {
+			s.Status = SENDER_STATUS_DOWN
+			h.dirty = true
+			h.log.Warn("Heartbeats stopped", "sender", s.Sender, "lastSeen", s.LastSeen.Format(time.RFC3339))
+			h.runHook(*s)
+		}
+	}
+	if conf.Receiver.HealthFile == "" || (!h.dirty && time.Since(h.written) < HEALTH_FILE_INTERVAL) {
+		return
+	}
+	status := healthStatus{Updated: time.Now(), Senders: []senderHealth{}}
+	for _, s := range h.senders {
+		status.Senders = append(status.Senders, *s)
+	}
+	sort.Slice(status.Senders, func(i, j int) bool {
+		return status.Senders[i].Sender < status.Senders[j].Sender
+	})
+	err := writeState(conf.Receiver.HealthFile, &status)
+	if err != nil {
+		h.log.Error("Failed to write health file", "path", conf.Receiver.HealthFile, "err", err)
+		return
+	}
+	h.written = status.Updated
+	h.dirty = false
+}
+
+// runHook runs the heartbeat exec hook with the sender id and its new status
+func (h *healthMonitor) runHook(s senderHealth) {
+	conf := h.conf
+	if conf.Receiver.HeartbeatExec == "" {
+		return
+	}
+	cmd := exec.Command(conf.Receiver.HeartbeatExec, s.Sender, s.Status)
+	cmd.Env = append(os.Environ(),
+		"GODIODE_SENDER="+s.Sender,
+		"GODIODE_STATUS="+s.Status,
+		"GODIODE_LAST_SEEN="+s.LastSeen.Format(time.RFC3339),
+		"GODIODE_QUEUE="+strconv.FormatUint(uint64(s.Queue), 10))
+	go func() {
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			h.log.Error("Heartbeat hook failed", "sender", s.Sender, "status", s.Status, "err", err, "output", strings.TrimSpace(string(out)))
+		}
+	}()
+}
+
+// monitorHealth handles the heartbeats read by packets, checking for senders
+// gone silent every second until the returned func is called. Heartbeat
+// timestamps are persisted by replay, or the state file if replay is nil.
+func (r *Receiver) monitorHealth(packets *packetReader, replay *replayGuard) (func(), error) {
+	conf := r.conf
+	if conf.Receiver.HeartbeatTimeout <= 0 {
+		return func() {}, nil
+	}
+	v, err := newVerifier(conf, r.metrics)
+	if err != nil {
+		return nil, err
+	}
+	if replay == nil {
+		replay, err = newReplayGuard(conf.StateFile, conf.Receiver.MaxClockSkew)
+		if err != nil {
+			return nil, err
+		}
+	}
+	h := &healthMonitor{conf: conf, log: r.log, metrics: r.metrics, verifier: v, replay: replay, started: time.Now(), senders: map[string]*senderHealth{}, dirty: true}
+	packets.health = h
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			h.check()
+			select {
+			case <-t.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}, nil
+}
@@ -0,0 +1,176 @@
+package godiode
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatRejected(t *testing.T) {
+	conf := testConfig(t)
+	conf.Logger = &Logger{out: ioutil.Discard}
+	sig := newHmacSigner(conf.HMACSecret)
+	stateFile := path.Join(t.TempDir(), "state.json")
+	newMonitor := func() *healthMonitor {
+		replay, err := newReplayGuard(stateFile, conf.Receiver.MaxClockSkew)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &healthMonitor{conf: conf, log: conf.Logger, metrics: NewMetrics(), verifier: sig, replay: replay, started: time.Now(), senders: map[string]*senderHealth{}}
+	}
+	h := newMonitor()
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	pkt := heartbeatPacket(sig, 1, "plant", "v1.2.3", now, 7)
+	err := h.onHeartbeat(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := h.senders["plant"]
+	if s == nil || s.Status != SENDER_STATUS_UP || s.Version != "v1.2.3" || s.Queue != 7 || s.Heartbeats != 1 {
+		t.Fatalf("unexpected health %+v", s)
+	}
+	if err := h.onHeartbeat(pkt); err == nil {
+		t.Error("accepted replayed heartbeat")
+	}
+	// the timestamp survives a receiver restart
+	if err := newMonitor().onHeartbeat(pkt); err == nil {
+		t.Error("accepted replayed heartbeat after restart")
+	}
+	pkt = heartbeatPacket(sig, 1, "plant", "v1.2.3", now+1000, 7)
+	pkt[14]++
+	if err := h.onHeartbeat(pkt); err == nil {
+		t.Error("accepted tampered heartbeat")
+	}
+	pkt = heartbeatPacket(newHmacSigner("other secret"), 1, "plant", "v1.2.3", now+1000, 7)
+	if err := h.onHeartbeat(pkt); err == nil {
+		t.Error("accepted heartbeat with the wrong secret")
+	}
+	pkt = heartbeatPacket(sig, 1, "plant", "v1.2.3", now+3600*1000, 7)
+	if err := h.onHeartbeat(pkt); err == nil {
+		t.Error("accepted heartbeat from the future")
+	}
+	if h.senders["plant"].Heartbeats != 1 {
+		t.Error("rejected heartbeats counted")
+	}
+}
+
+func TestHeartbeatEncrypted(t *testing.T) {
+	conf := testConfig(t)
+	conf.Logger = &Logger{out: ioutil.Discard}
+	conf.EncryptionKey = "test key"
+	sig := newHmacSigner(conf.HMACSecret)
+	replay, err := newReplayGuard("", conf.Receiver.MaxClockSkew)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &healthMonitor{conf: conf, log: conf.Logger, metrics: NewMetrics(), verifier: sig, replay: replay, started: time.Now(), senders: map[string]*senderHealth{}}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	if err := h.onHeartbeat(heartbeatPacket(sig, 1, "plant", "v1", now, 0)); err == nil {
+		t.Error("accepted plain heartbeat with encryption")
+	}
+	sc, err := newSenderCipher(conf.EncryptionKey, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := sealSalted(sc, nil, heartbeatPacket(sig, 1, "plant", "v1", now+1, 0))
+	if bytes.Contains(pkt, []byte("plant")) {
+		t.Error("sender id in clear text")
+	}
+	if err := h.onHeartbeat(pkt); err != nil {
+		t.Fatal(err)
+	}
+	// without persisted timestamps, heartbeats older than the receiver are
+	// rejected
+	pkt = sealSalted(sc, nil, heartbeatPacket(sig, 1, "other", "v1", now-60*1000, 0))
+	if err := h.onHeartbeat(pkt); err == nil {
+		t.Error("accepted heartbeat sent before the receiver started")
+	}
+}
+
+func readHealth(t *testing.T, file string) healthStatus {
+	t.Helper()
+	var status healthStatus
+	data, err := ioutil.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(data, &status)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return status
+}
+
+// waitHealth waits for the health file to report the sender with status
+func waitHealth(t *testing.T, file string, sender string, status string) senderHealth {
+	t.Helper()
+	timeout := time.Now().Add(10 * time.Second)
+	for time.Now().Before(timeout) {
+		for _, s := range readHealth(t, file).Senders {
+			if s.Sender == sender && s.Status == status {
+				return s
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("sender %s not reported %s", sender, status)
+	return senderHealth{}
+}
+
+func TestHeartbeatHealth(t *testing.T) {
+	conf := testConfig(t)
+	conf.Sender.ID = "plant"
+	conf.Sender.HeartbeatInterval = 1
+	conf.Receiver.HeartbeatTimeout = 2
+	conf.Receiver.HealthFile = path.Join(t.TempDir(), "health.json")
+	hookOut := path.Join(t.TempDir(), "hook.out")
+	if runtime.GOOS != "windows" {
+		conf.Receiver.HeartbeatExec = path.Join(t.TempDir(), "hook.sh")
+		err := ioutil.WriteFile(conf.Receiver.HeartbeatExec, []byte("#!/bin/sh\necho \"$1 $2 $GODIODE_SENDER\" >> "+hookOut+"\n"), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n := NewMemoryNetwork(Impairment{})
+	startReceiver(t, conf, n.Listen(), t.TempDir())
+	s, err := NewSender(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Transport = n.Dial()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Watch(ctx, t.TempDir()) }()
+
+	up := waitHealth(t, conf.Receiver.HealthFile, "plant", SENDER_STATUS_UP)
+	if up.Queue != 0 || up.Version == "" {
+		t.Errorf("unexpected health %+v", up)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatal(err)
+	}
+	waitHealth(t, conf.Receiver.HealthFile, "plant", SENDER_STATUS_DOWN)
+
+	if conf.Receiver.HeartbeatExec != "" {
+		timeout := time.Now().Add(5 * time.Second)
+		out := ""
+		for time.Now().Before(timeout) && out == "" {
+			data, _ := ioutil.ReadFile(hookOut)
+			out = string(data)
+			time.Sleep(100 * time.Millisecond)
+		}
+		if strings.TrimSpace(out) != "plant down plant" {
+			t.Errorf("unexpected hook output %q", out)
+		}
+	}
+}
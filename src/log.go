@@ -0,0 +1,204 @@
+package godiode
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Logging
+ *
+ * Every event is written as a single line, either as text
+ *
+ * 2006-01-02T15:04:05.000Z07:00 info Received file manifest=1a2b3c4d file=3 path=a/b.txt
+ *
+ * or as a JSON object with the time, level, msg and the event fields
+ *
+ * {"time":"...","level":"info","msg":"Received file","manifest":"1a2b3c4d","file":3,"path":"a/b.txt"}
+ *
+ * Manifest and stream ids are hex strings, file is the index of the file in
+ * the manifest.
+ */
+
+const (
+	LOG_DEBUG = iota
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+)
+
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+const LOG_FORMAT_TEXT = "text"
+const LOG_FORMAT_JSON = "json"
+
+const LOG_TIME_FORMAT = "2006-01-02T15:04:05.000Z07:00"
+
+// Logger writes leveled events with key value fields
+type Logger struct {
+	lock  sync.Mutex
+	out   io.Writer
+	level int
+	json  bool
+}
+
+// NewLogger creates a logger writing to out with the log level and format of
+// conf, verbose lowers the level to info
+func NewLogger(out io.Writer, conf *Config) (*Logger, error) {
+	level := -1
+	for i, name := range logLevels {
+		if conf.LogLevel == name {
+			level = i
+		}
+	}
+	if level < 0 {
+		return nil, errors.New("Invalid log level " + conf.LogLevel)
+	}
+	if conf.LogFormat != LOG_FORMAT_TEXT && conf.LogFormat != LOG_FORMAT_JSON {
+		return nil, errors.New("Invalid log format " + conf.LogFormat)
+	}
+	if conf.Verbose && level > LOG_INFO {
+		level = LOG_INFO
+	}
+	return &Logger{out: out, level: level, json: conf.LogFormat == LOG_FORMAT_JSON}, nil
+}
+
+// configLogger returns the logger of conf, by default a new one writing to
+// stderr
+func configLogger(conf *Config) (*Logger, error) {
+	if conf.Logger != nil {
+		return conf.Logger, nil
+	}
+	return NewLogger(os.Stderr, conf)
+}
+
+// Debug logs details useful when troubleshooting
+func (l *Logger) Debug(msg string, fields ...interface{}) {
+	l.write(LOG_DEBUG, msg, fields)
+}
+
+// Info logs progress, such as files sent and received
+func (l *Logger) Info(msg string, fields ...interface{}) {
+	l.write(LOG_INFO, msg, fields)
+}
+
+// Warn logs rejected packets and other problems that do not fail a transfer
+func (l *Logger) Warn(msg string, fields ...interface{}) {
+	l.write(LOG_WARN, msg, fields)
+}
+
+// Error logs failed transfers and operations
+func (l *Logger) Error(msg string, fields ...interface{}) {
+	l.write(LOG_ERROR, msg, fields)
+}
+
+// warnErr logs msg with err as the reason, along with the fields of err if
+// it is a fieldError
+func (l *Logger) warnErr(msg string, err error, fields ...interface{}) {
+	var fe *fieldError
+	if errors.As(err, &fe) {
+		l.Warn(msg, append(append(fields, fe.fields...), "reason", fe.msg)...)
+		return
+	}
+	l.Warn(msg, append(fields, "reason", err)...)
+}
+
+// fieldError is an error with fields identifying the file, manifest, stream
+// or sender it is about, logged as structured fields by warnErr
+type fieldError struct {
+	msg    string
+	fields []interface{}
+}
+
+// fieldErr creates an error with fields of alternating keys and values
+func fieldErr(msg string, fields ...interface{}) error {
+	return &fieldError{msg, fields}
+}
+
+// withFields adds fields to err, making it a fieldError
+func withFields(err error, fields ...interface{}) error {
+	var fe *fieldError
+	if errors.As(err, &fe) {
+		return &fieldError{fe.msg, append(fields, fe.fields...)}
+	}
+	return &fieldError{err.Error(), fields}
+}
+
+func (e *fieldError) Error() string {
+	s := e.msg
+	for i := 0; i+1 < len(e.fields); i += 2 {
+		s += " " + fmt.Sprint(e.fields[i]) + "=" + textValue(e.fields[i+1])
+	}
+	return s
+}
+
+// write formats the event as a single line, fields are alternating keys and
+// values
+func (l *Logger) write(level int, msg string, fields []interface{}) {
+	if level < l.level {
+		return
+	}
+	var b strings.Builder
+	now := time.Now().Format(LOG_TIME_FORMAT)
+	if l.json {
+		b.WriteString(`{"time":"` + now + `","level":"` + logLevels[level] + `","msg":` + jsonValue(msg))
+	} else {
+		b.WriteString(now + " " + logLevels[level] + " " + msg)
+	}
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		var value interface{} = "MISSING"
+		if i+1 < len(fields) {
+			value = fields[i+1]
+		}
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		if l.json {
+			b.WriteString("," + jsonValue(key) + ":" + jsonValue(value))
+		} else {
+			b.WriteString(" " + key + "=" + textValue(value))
+		}
+	}
+	if l.json {
+		b.WriteString("}")
+	}
+	b.WriteString("\n")
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	io.WriteString(l.out, b.String())
+}
+
+func jsonValue(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return string(data)
+}
+
+// textValue quotes strings that would be ambiguous unquoted
+func textValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" {
+		return `""`
+	}
+	for _, r := range s {
+		if r == ' ' || r == '=' || r == '"' || !strconv.IsPrint(r) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+// hexId formats manifest and stream ids
+func hexId(id uint32) string {
+	return strconv.FormatUint(uint64(id), 16)
+}
@@ -0,0 +1,125 @@
+package godiode
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLoggerText(t *testing.T) {
+	conf := DefaultConfig()
+	var buff bytes.Buffer
+	l, err := NewLogger(&buff, &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Info("hidden")
+	l.Warn("Rejected packet", "path", "a b/c.txt", "file", 3, "err", errors.New("bad"), "empty", "")
+	line := buff.String()
+	if strings.Contains(line, "hidden") {
+		t.Fatal("logged below the log level")
+	}
+	if !strings.HasSuffix(line, ` warn Rejected packet path="a b/c.txt" file=3 err=bad empty=""`+"\n") {
+		t.Fatalf("unexpected line %q", line)
+	}
+}
+
+func TestLoggerFieldError(t *testing.T) {
+	conf := DefaultConfig()
+	var buff bytes.Buffer
+	l, err := NewLogger(&buff, &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = withFields(fieldErr("Replayed stream", "stream", "beef"), "sender", "plant a")
+	if err.Error() != `Replayed stream sender="plant a" stream=beef` {
+		t.Errorf("unexpected error %q", err.Error())
+	}
+	l.warnErr("Rejected stream", err, "manifest", "1")
+	l.warnErr("Rejected stream", errors.New("bad"))
+	lines := strings.Split(buff.String(), "\n")
+	if !strings.HasSuffix(lines[0], ` warn Rejected stream manifest=1 sender="plant a" stream=beef reason="Replayed stream"`) {
+		t.Errorf("unexpected line %q", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], ` warn Rejected stream reason=bad`) {
+		t.Errorf("unexpected line %q", lines[1])
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	conf := DefaultConfig()
+	conf.LogFormat = LOG_FORMAT_JSON
+	conf.Verbose = true
+	var buff bytes.Buffer
+	l, err := NewLogger(&buff, &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Debug("hidden")
+	l.Info("Received file", "manifest", hexId(0xbeef), "file", 1, "path", "\"quoted\"\n", "size", int64(42))
+	var event map[string]interface{}
+	err = json.Unmarshal(buff.Bytes(), &event)
+	if err != nil {
+		t.Fatalf("invalid line %q: %v", buff.String(), err)
+	}
+	expected := map[string]interface{}{"level": "info", "msg": "Received file", "manifest": "beef", "file": 1.0, "path": "\"quoted\"\n", "size": 42.0}
+	for k, v := range expected {
+		if event[k] != v {
+			t.Errorf("%s is %v, expected %v", k, event[k], v)
+		}
+	}
+	if _, exists := event["time"]; !exists {
+		t.Error("missing time")
+	}
+}
+
+func TestLoggerInvalidConfig(t *testing.T) {
+	conf := DefaultConfig()
+	conf.LogLevel = "verbose"
+	if _, err := NewReceiver(&conf); err == nil {
+		t.Error("accepted invalid log level")
+	}
+	conf = DefaultConfig()
+	conf.LogFormat = "xml"
+	if _, err := NewSender(&conf); err == nil {
+		t.Error("accepted invalid log format")
+	}
+}
+
+func TestTransferEvents(t *testing.T) {
+	conf := testConfig(t)
+	conf.LogLevel = "info"
+	conf.LogFormat = LOG_FORMAT_JSON
+	var buff bytes.Buffer
+	l, err := NewLogger(&buff, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Logger = l
+	testTransfer(t, conf, Impairment{})
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	received := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(buff.String()), "\n") {
+		var event map[string]interface{}
+		err = json.Unmarshal([]byte(line), &event)
+		if err != nil {
+			t.Fatalf("invalid line %q: %v", line, err)
+		}
+		if event["msg"] != "Received file" {
+			continue
+		}
+		if event["manifest"] == nil || event["file"] == nil || event["checksum"] == nil {
+			t.Errorf("incomplete event %q", line)
+		}
+		received[event["path"].(string)] = true
+	}
+	for p := range testTree() {
+		if !received[p] {
+			t.Errorf("no event for %s", p)
+		}
+	}
+}
@@ -1,19 +1,21 @@
-package main
+package godiode
 
 import (
-	"bytes"
-	"crypto/hmac"
-	"crypto/sha512"
 	"encoding/binary"
 	"errors"
-	"io"
 	"io/fs"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
+// fixed size of the records in a manifest, excluding the path
+const DIR_RECORD_SIZE = 2 + 4
+const FILE_RECORD_SIZE = 2 + 4 + 8
+
 type DirRecord struct {
 	path  string
 	modts uint32
@@ -25,13 +27,28 @@ type FileRecord struct {
 }
 
 type Manifest struct {
-	dirs  []DirRecord
-	files []FileRecord
+	senderId  string
+	timestamp int64
+	sequence  uint64
+	features  uint32
+	// manifest id and timestamp of the session resent, with FEATURE_RESEND
+	originId        uint32
+	originTimestamp int64
+	dirs            []DirRecord
+	files           []FileRecord
 }
 
 /**
  * Manifest format
- * <number of dirs> | <dir-records> | <file records> | <signature>
+ * <sender> | <number of dirs> | <dir-records> | <file records> | <signature>
+ * sender:
+ *		len uint8 - sender id string length
+ *      senderId string - id of the sending system
+ *      timestamp int64 - creation time of the manifest (unix millis)
+ *      sequence uint64 - sequence number, increasing for every manifest of the sender
+ *      features uint32 - feature flags of the session, see protocol.go
+ *      originId uint32 - manifest id of the session resent, only with FEATURE_RESEND
+ *      originTimestamp int64 - timestamp of the manifest resent, only with FEATURE_RESEND
  * number of dirs - uint32 - number of directory records
  * number of files - uint32 - number of file records
  * dir-records:
@@ -43,56 +60,115 @@ type Manifest struct {
  *      path string - path of the file
  *      modts uint32 - the modification ts of the folder (unix epoch seconds)
  *      size uint64 - size of the file in bytes
- * signature byte[64] - hmac512 of this packet
+ * signature - hmac512 or ed25519 signature of this packet, see sign.go
  */
-func deserializeManifest(data []byte, hmacSecret string) (*Manifest, error) {
+func deserializeManifest(data []byte, v verifier) (*Manifest, error) {
 	l := len(data)
-	if l < 64+4+4 {
+	if l < v.size()+1+8+8+4+4+4 {
 		return nil, errors.New("Truncated manifest")
 	}
-	h512 := sha512.New()
-	io.WriteString(h512, hmacSecret)
-	mac := hmac.New(sha512.New, h512.Sum(nil))
-	mac.Write(data[:l-64])
-	sign := mac.Sum(nil)
-	if !bytes.Equal(sign, data[l-64:]) {
-		return nil, errors.New("Invalid manifest signature")
+	err := v.verify(data[:l-v.size()], data[l-v.size():])
+	if err != nil {
+		return nil, errors.New("Invalid manifest signature: " + err.Error())
 	}
+	data = data[:l-v.size()]
+	l = len(data)
 
 	manifest := Manifest{}
-	dl := int(binary.BigEndian.Uint32(data[0:]))
-	fl := int(binary.BigEndian.Uint32(data[4:]))
+	slen := int(data[0])
+	if l < 1+slen+8+8+4+4+4 {
+		return nil, errors.New("Truncated manifest")
+	}
+	manifest.senderId = string(data[1 : 1+slen])
+	offset := 1 + slen
+	manifest.timestamp = int64(binary.BigEndian.Uint64(data[offset:]))
+	offset += 8
+	manifest.sequence = binary.BigEndian.Uint64(data[offset:])
+	offset += 8
+	manifest.features = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	if manifest.features&FEATURE_RESEND != 0 {
+		if l < offset+4+8+4+4 {
+			return nil, errors.New("Truncated manifest")
+		}
+		manifest.originId = binary.BigEndian.Uint32(data[offset:])
+		manifest.originTimestamp = int64(binary.BigEndian.Uint64(data[offset+4:]))
+		offset += 4 + 8
+	}
+	dl := uint64(binary.BigEndian.Uint32(data[offset:]))
+	fl := uint64(binary.BigEndian.Uint32(data[offset+4:]))
+	offset += 8
 
-	offset := 8
-	//TODO: check lengths
+	// every record takes at least its fixed size, cap the counts before allocating
+	if dl*DIR_RECORD_SIZE+fl*FILE_RECORD_SIZE > uint64(l-offset) {
+		return nil, errors.New("Too many records for manifest size")
+	}
 	manifest.dirs = make([]DirRecord, dl)
 	manifest.files = make([]FileRecord, fl)
-	for i := 0; i < dl; i++ {
-		plen := int(binary.BigEndian.Uint16(data[offset:]) & 0xFFFF)
-		offset += 2
-		//TODO: check lengths
-		p := string(data[offset : offset+plen])
-		offset += plen
+	for i := range manifest.dirs {
+		p, next, err := readManifestPath(data, offset, DIR_RECORD_SIZE)
+		if err != nil {
+			return nil, err
+		}
+		offset = next
 		modts := binary.BigEndian.Uint32(data[offset:])
 		offset += 4
 		manifest.dirs[i] = DirRecord{p, modts}
 	}
-	for i := 0; i < fl; i++ {
-		plen := int(binary.BigEndian.Uint16(data[offset:]) & 0xFFFF)
-		offset += 2
-		//TODO: check lengths
-		p := string(data[offset : offset+plen])
-		offset += plen
+	for i := range manifest.files {
+		p, next, err := readManifestPath(data, offset, FILE_RECORD_SIZE)
+		if err != nil {
+			return nil, err
+		}
+		offset = next
 		modts := binary.BigEndian.Uint32(data[offset:])
 		offset += 4
 		s := binary.BigEndian.Uint64(data[offset:])
 		offset += 8
+		if s > math.MaxInt64 {
+			return nil, errors.New("Invalid size of file " + p + " in manifest")
+		}
 		manifest.files[i] = FileRecord{DirRecord{p, modts}, int64(s)}
 	}
+	if offset != l {
+		return nil, errors.New("Trailing data in manifest")
+	}
 	return &manifest, nil
 }
 
-func (m *Manifest) serializeManifest(hmacSecret string) ([]byte, error) {
+// readManifestPath reads the path of the record at offset, checking that the
+// rest of the record of size recordSize (without the path) fits in data
+func readManifestPath(data []byte, offset int, recordSize int) (string, int, error) {
+	if len(data)-offset < recordSize {
+		return "", 0, errors.New("Truncated manifest record")
+	}
+	plen := int(binary.BigEndian.Uint16(data[offset:]))
+	offset += 2
+	if len(data)-offset < plen+recordSize-2 {
+		return "", 0, errors.New("Truncated manifest record")
+	}
+	p := string(data[offset : offset+plen])
+	err := checkManifestPath(p)
+	if err != nil {
+		return "", 0, err
+	}
+	return p, offset + plen, nil
+}
+
+// checkManifestPath rejects paths that would end up outside of the receive dir
+func checkManifestPath(p string) error {
+	if p == "" || strings.HasPrefix(p, "/") || strings.IndexByte(p, 0) >= 0 {
+		return errors.New("Invalid path in manifest: " + strconv.Quote(p))
+	}
+	for _, e := range strings.Split(p, "/") {
+		if e == ".." {
+			return errors.New("Invalid path in manifest: " + strconv.Quote(p))
+		}
+	}
+	return nil
+}
+
+func (m *Manifest) serializeManifest(s signer) ([]byte, error) {
 	dirsSize := 0
 	filesSize := 0
 	for i := range m.dirs {
@@ -101,10 +177,30 @@ func (m *Manifest) serializeManifest(hmacSecret string) ([]byte, error) {
 	for i := range m.files {
 		filesSize += 2 + len(m.files[i].path) + 4 + 8
 	}
-	manifest := make([]byte, 4+4+dirsSize+filesSize+64)
-	binary.BigEndian.PutUint32(manifest, uint32(len(m.dirs)))
-	binary.BigEndian.PutUint32(manifest[4:], uint32(len(m.files)))
-	offset := 8
+	if len(m.senderId) > 255 {
+		return nil, errors.New("Too long sender id")
+	}
+	originSize := 0
+	if m.features&FEATURE_RESEND != 0 {
+		originSize = 4 + 8
+	}
+	manifest := make([]byte, 1+len(m.senderId)+8+8+4+originSize+4+4+dirsSize+filesSize+s.size())
+	manifest[0] = byte(len(m.senderId))
+	offset := 1 + copy(manifest[1:], m.senderId)
+	binary.BigEndian.PutUint64(manifest[offset:], uint64(m.timestamp))
+	offset += 8
+	binary.BigEndian.PutUint64(manifest[offset:], m.sequence)
+	offset += 8
+	binary.BigEndian.PutUint32(manifest[offset:], m.features)
+	offset += 4
+	if m.features&FEATURE_RESEND != 0 {
+		binary.BigEndian.PutUint32(manifest[offset:], m.originId)
+		binary.BigEndian.PutUint64(manifest[offset+4:], uint64(m.originTimestamp))
+		offset += 4 + 8
+	}
+	binary.BigEndian.PutUint32(manifest[offset:], uint32(len(m.dirs)))
+	binary.BigEndian.PutUint32(manifest[offset+4:], uint32(len(m.files)))
+	offset += 8
 
 	for i := range m.dirs {
 		d := m.dirs[i]
@@ -127,17 +223,12 @@ func (m *Manifest) serializeManifest(hmacSecret string) ([]byte, error) {
 		offset += 8
 	}
 
-	h512 := sha512.New()
-	io.WriteString(h512, hmacSecret)
-	mac := hmac.New(sha512.New, h512.Sum(nil))
-	mac.Write(manifest[:offset])
-	sign := mac.Sum(nil)
-	copy(manifest[offset:], sign)
+	copy(manifest[offset:], s.sign(manifest[:offset]))
 	return manifest, nil
 }
 
 func generateManifest(dir string) (*Manifest, error) {
-	manifest := Manifest{make([]DirRecord, 0), make([]FileRecord, 0)}
+	manifest := Manifest{dirs: make([]DirRecord, 0), files: make([]FileRecord, 0)}
 	dir = path.Clean(dir)
 	finfo, err := os.Stat(dir)
 	if err != nil {
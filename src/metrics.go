@@ -0,0 +1,250 @@
+package godiode
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * Metrics
+ *
+ * Counters of the senders and receivers sharing a Metrics registry, exposed
+ * in the Prometheus text format by its Handler. Senders and receivers without
+ * a registry in their config count in one of their own. The zero value is an
+ * empty registry.
+ */
+
+type counter uint64
+
+func (c *counter) add(n uint64) {
+	atomic.AddUint64((*uint64)(c), n)
+}
+
+func (c *counter) set(n uint64) {
+	atomic.StoreUint64((*uint64)(c), n)
+}
+
+func (c *counter) get() uint64 {
+	return atomic.LoadUint64((*uint64)(c))
+}
+
+var packetTypes = [...]struct {
+	ptype byte
+	name  string
+}{
+	{0x00, "heartbeat"},
+	{0x01, "manifest"},
+	{0x02, "start"},
+	{0x03, "complete"},
+	{0x04, "repair"},
+	{0x05, "stream"},
+	{0x06, "relay"},
+	{0x80, "data"},
+}
+
+// packet types counted, unknown types last
+const METRIC_PACKET_TYPES = len(packetTypes) + 1
+
+const (
+	AUTH_SIGNATURE = iota
+	AUTH_MAC
+	AUTH_DECRYPTION
+
+	AUTH_CHECKS
+)
+
+var authChecks = [AUTH_CHECKS]string{"signature", "mac", "decryption"}
+
+// Metrics is a registry of the counters of senders and receivers
+type Metrics struct {
+	// by index in packetTypes
+	rxPackets [METRIC_PACKET_TYPES]counter
+	rxBytes   [METRIC_PACKET_TYPES]counter
+	txPackets counter
+	txBytes   counter
+	// by AUTH_ check
+	authFailures      [AUTH_CHECKS]counter
+	checksumFailures  counter
+	outOfOrderAborts  counter
+	manifestsReceived counter
+	// manifests ignored as their id is used by another session
+	manifestCollisions counter
+	filesCommitted     counter
+	committedBytes     counter
+	throttleWait       counter
+	rounds             counter
+
+	lock       sync.Mutex
+	roundBytes map[int]uint64
+	rxRate     float64
+	txRate     float64
+	sampler    sync.Once
+	stop       chan struct{}
+	stopped    sync.Once
+}
+
+// NewMetrics creates an empty registry
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+// configMetrics returns the registry of conf, by default a new one
+func configMetrics(conf *Config) *Metrics {
+	if conf.Metrics != nil {
+		return conf.Metrics
+	}
+	return NewMetrics()
+}
+
+func (m *Metrics) received(ptype byte, size int) {
+	i := len(packetTypes)
+	for j := range packetTypes {
+		if packetTypes[j].ptype == ptype {
+			i = j
+			break
+		}
+	}
+	m.rxPackets[i].add(1)
+	m.rxBytes[i].add(uint64(size))
+}
+
+func (m *Metrics) authFailed(check int) {
+	m.authFailures[check].add(1)
+}
+
+func (m *Metrics) roundSent(round int, bytes uint64) {
+	m.rounds.add(1)
+	m.lock.Lock()
+	if m.roundBytes == nil {
+		m.roundBytes = map[int]uint64{}
+	}
+	m.roundBytes[round] += bytes
+	m.lock.Unlock()
+}
+
+func (m *Metrics) stopChan() chan struct{} {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.stop == nil {
+		m.stop = make(chan struct{})
+	}
+	return m.stop
+}
+
+// Close stops updating the throughput served by the Handler
+func (m *Metrics) Close() {
+	m.stopped.Do(func() {
+		close(m.stopChan())
+	})
+}
+
+// sample updates the throughput every second until the registry is closed
+func (m *Metrics) sample() {
+	stop := m.stopChan()
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	rx, tx := m.totalReceived(), m.txBytes.get()
+	last := time.Now()
+	for {
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
+		nrx, ntx := m.totalReceived(), m.txBytes.get()
+		secs := time.Since(last).Seconds()
+		last = time.Now()
+		m.lock.Lock()
+		m.rxRate = float64(nrx-rx) / secs
+		m.txRate = float64(ntx-tx) / secs
+		m.lock.Unlock()
+		rx, tx = nrx, ntx
+	}
+}
+
+func (m *Metrics) totalReceived() uint64 {
+	total := uint64(0)
+	for i := range m.rxBytes {
+		total += m.rxBytes[i].get()
+	}
+	return total
+}
+
+func writeMetric(w io.Writer, name string, mtype string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, mtype)
+}
+
+func (m *Metrics) write(w io.Writer) {
+	typeName := func(i int) string {
+		if i < len(packetTypes) {
+			return packetTypes[i].name
+		}
+		return "unknown"
+	}
+	writeMetric(w, "godiode_received_packets_total", "counter", "Packets received by packet type.")
+	for i := range m.rxPackets {
+		fmt.Fprintf(w, "godiode_received_packets_total{type=%q} %d\n", typeName(i), m.rxPackets[i].get())
+	}
+	writeMetric(w, "godiode_received_bytes_total", "counter", "Bytes received by packet type, including the protocol header.")
+	for i := range m.rxBytes {
+		fmt.Fprintf(w, "godiode_received_bytes_total{type=%q} %d\n", typeName(i), m.rxBytes[i].get())
+	}
+	writeMetric(w, "godiode_auth_failures_total", "counter", "Packets rejected by HMAC or ed25519 signature, data MAC or decryption checks.")
+	for i := range m.authFailures {
+		fmt.Fprintf(w, "godiode_auth_failures_total{check=%q} %d\n", authChecks[i], m.authFailures[i].get())
+	}
+	writeMetric(w, "godiode_checksum_failures_total", "counter", "Received files failing the checksum.")
+	fmt.Fprintf(w, "godiode_checksum_failures_total %d\n", m.checksumFailures.get())
+	writeMetric(w, "godiode_out_of_order_aborts_total", "counter", "Manifests and proxied streams aborted on out of order or lost packets.")
+	fmt.Fprintf(w, "godiode_out_of_order_aborts_total %d\n", m.outOfOrderAborts.get())
+	writeMetric(w, "godiode_manifests_received_total", "counter", "Valid manifests received.")
+	fmt.Fprintf(w, "godiode_manifests_received_total %d\n", m.manifestsReceived.get())
+	writeMetric(w, "godiode_manifest_collisions_total", "counter", "Valid manifests ignored as their id is used by the session of another manifest.")
+	fmt.Fprintf(w, "godiode_manifest_collisions_total %d\n", m.manifestCollisions.get())
+	writeMetric(w, "godiode_files_committed_total", "counter", "Received files moved to the receive dir.")
+	fmt.Fprintf(w, "godiode_files_committed_total %d\n", m.filesCommitted.get())
+	writeMetric(w, "godiode_committed_bytes_total", "counter", "Content bytes of the received files moved to the receive dir.")
+	fmt.Fprintf(w, "godiode_committed_bytes_total %d\n", m.committedBytes.get())
+	writeMetric(w, "godiode_sent_packets_total", "counter", "Packets sent.")
+	fmt.Fprintf(w, "godiode_sent_packets_total %d\n", m.txPackets.get())
+	writeMetric(w, "godiode_sent_bytes_total", "counter", "Bytes sent, including the protocol header.")
+	fmt.Fprintf(w, "godiode_sent_bytes_total %d\n", m.txBytes.get())
+	writeMetric(w, "godiode_throttle_wait_seconds_total", "counter", "Time the sender waited for the bandwidth throttle.")
+	fmt.Fprintf(w, "godiode_throttle_wait_seconds_total %s\n", strconv.FormatFloat(time.Duration(m.throttleWait.get()).Seconds(), 'f', -1, 64))
+	writeMetric(w, "godiode_rounds_total", "counter", "Transmission rounds sent.")
+	fmt.Fprintf(w, "godiode_rounds_total %d\n", m.rounds.get())
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	rounds := []int{}
+	for r := range m.roundBytes {
+		rounds = append(rounds, r)
+	}
+	sort.Ints(rounds)
+	writeMetric(w, "godiode_round_sent_bytes_total", "counter", "Bytes sent by transmission round of a manifest session, 1 is the first round.")
+	for _, r := range rounds {
+		fmt.Fprintf(w, "godiode_round_sent_bytes_total{round=\"%d\"} %d\n", r, m.roundBytes[r])
+	}
+	writeMetric(w, "godiode_receive_throughput_bytes", "gauge", "Bytes received per second during the last second.")
+	fmt.Fprintf(w, "godiode_receive_throughput_bytes %s\n", strconv.FormatFloat(m.rxRate, 'f', -1, 64))
+	writeMetric(w, "godiode_send_throughput_bytes", "gauge", "Bytes sent per second during the last second.")
+	fmt.Fprintf(w, "godiode_send_throughput_bytes %s\n", strconv.FormatFloat(m.txRate, 'f', -1, 64))
+}
+
+// Handler serves the metrics of the registry in the Prometheus text format,
+// updating the throughput every second until Close is called
+func (m *Metrics) Handler() http.Handler {
+	m.sampler.Do(func() {
+		go m.sample()
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.write(w)
+	})
+}
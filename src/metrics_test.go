@@ -0,0 +1,102 @@
+package godiode
+
+import (
+	"bufio"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrapeMetrics returns the samples served by the handler of m by name and
+// labels
+func scrapeMetrics(t *testing.T, m *Metrics) map[string]float64 {
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("content type %q", ct)
+	}
+	samples := map[string]float64{}
+	sc := bufio.NewScanner(w.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("invalid sample %q", line)
+		}
+		samples[line[:i]] = v
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	conf := testConfig(t)
+	conf.Metrics = NewMetrics()
+	other := NewMetrics()
+	testTransfer(t, conf, Impairment{})
+	samples := scrapeMetrics(t, conf.Metrics)
+
+	tree := testTree()
+	size := 0
+	for _, data := range tree {
+		size += len(data)
+	}
+	for name, value := range map[string]float64{
+		"godiode_files_committed_total":    float64(len(tree)),
+		"godiode_committed_bytes_total":    float64(size),
+		"godiode_rounds_total":             float64(testConfig(t).ResendCount),
+		"godiode_manifests_received_total": 1,
+	} {
+		if samples[name] != value {
+			t.Errorf("%s is %v, expected %v", name, samples[name], value)
+		}
+	}
+	for _, name := range []string{
+		"godiode_sent_packets_total",
+		"godiode_sent_bytes_total",
+		`godiode_received_packets_total{type="manifest"}`,
+		`godiode_received_packets_total{type="data"}`,
+		`godiode_round_sent_bytes_total{round="1"}`,
+	} {
+		if samples[name] == 0 {
+			t.Errorf("%s not counted", name)
+		}
+	}
+	// registries are not shared between senders and receivers
+	for name, value := range scrapeMetrics(t, other) {
+		if value != 0 {
+			t.Errorf("%s counted in an unused registry", name)
+		}
+	}
+}
+
+func TestMetricsZeroValue(t *testing.T) {
+	conf := testConfig(t)
+	conf.Metrics = &Metrics{}
+	testTransfer(t, conf, Impairment{})
+	samples := scrapeMetrics(t, conf.Metrics)
+	if samples[`godiode_round_sent_bytes_total{round="1"}`] == 0 {
+		t.Error("rounds not counted in a zero value registry")
+	}
+	conf.Metrics.Close()
+}
+
+func TestMetricsClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	m := NewMetrics()
+	m.Handler()
+	m.Close()
+	m.Close()
+	for i := 0; runtime.NumGoroutine() > before; i++ {
+		if i == 100 {
+			t.Fatal("throughput sampler not stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
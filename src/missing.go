@@ -0,0 +1,180 @@
+package godiode
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Missing list
+ *
+ * The files of a manifest session not received, written by the receiver next
+ * to the session report and carried back to the sender by other means, as
+ * there is no return path. A text file of one record per line:
+ *
+ * godiode-missing 1
+ * manifest <manifest id, hex>
+ * created <manifest timestamp, unix millis>
+ * sender <quoted sender id>
+ * file <quoted path>
+ * ...
+ * mac <hex hmac-sha256 of all lines above, keyed with the shared secret>
+ *
+ * The sender resends the files listed in a new manifest session, marked with
+ * FEATURE_RESEND and the id and timestamp of the original manifest, so the
+ * receiver updates the report of the original session.
+ */
+
+const MISSING_LIST_HEADER = "godiode-missing 1"
+
+// MissingList lists the files of a manifest session that were not received
+type MissingList struct {
+	// Manifest is the id of the manifest session
+	Manifest uint32
+	// Created is the timestamp of the manifest in unix millis
+	Created int64
+	Sender  string
+	Files   []string
+}
+
+func missingListMac(secret string) *packetMac {
+	h := sha256.New()
+	io.WriteString(h, "godiode-missing-list")
+	io.WriteString(h, secret)
+	return &packetMac{h.Sum(nil), sha256.New, sha256.Size}
+}
+
+func (l *MissingList) marshal(secret string) []byte {
+	var b bytes.Buffer
+	b.WriteString(MISSING_LIST_HEADER + "\n")
+	b.WriteString("manifest " + hexId(l.Manifest) + "\n")
+	b.WriteString("created " + strconv.FormatInt(l.Created, 10) + "\n")
+	b.WriteString("sender " + strconv.Quote(l.Sender) + "\n")
+	for _, f := range l.Files {
+		b.WriteString("file " + strconv.Quote(f) + "\n")
+	}
+	mac := missingListMac(secret).sum(b.Bytes())
+	b.WriteString("mac " + hex.EncodeToString(mac) + "\n")
+	return b.Bytes()
+}
+
+func parseMissingList(data []byte, secret string) (*MissingList, error) {
+	i := bytes.LastIndex(data, []byte("\nmac "))
+	if i < 0 {
+		return nil, errors.New("Missing list without MAC")
+	}
+	mac, err := hex.DecodeString(strings.TrimSpace(string(data[i+5:])))
+	if err != nil || !hmac.Equal(missingListMac(secret).sum(data[:i+1]), mac) {
+		return nil, errors.New("Invalid missing list MAC")
+	}
+	l := &MissingList{}
+	sc := bufio.NewScanner(bytes.NewReader(data[:i+1]))
+	sc.Buffer(nil, len(data))
+	if !sc.Scan() || sc.Text() != MISSING_LIST_HEADER {
+		return nil, errors.New("Unsupported missing list format")
+	}
+	for sc.Scan() {
+		key, value, _ := strings.Cut(sc.Text(), " ")
+		switch key {
+		case "manifest":
+			id, err := strconv.ParseUint(value, 16, 32)
+			if err != nil {
+				return nil, errors.New("Invalid manifest id in missing list")
+			}
+			l.Manifest = uint32(id)
+		case "created":
+			l.Created, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, errors.New("Invalid timestamp in missing list")
+			}
+		case "sender":
+			l.Sender, err = strconv.Unquote(value)
+			if err != nil {
+				return nil, errors.New("Invalid sender in missing list")
+			}
+		case "file":
+			p, err := strconv.Unquote(value)
+			if err == nil {
+				err = checkManifestPath(p)
+			}
+			if err != nil {
+				return nil, errors.New("Invalid file in missing list: " + value)
+			}
+			l.Files = append(l.Files, p)
+		default:
+			return nil, errors.New("Unknown record in missing list: " + key)
+		}
+	}
+	return l, nil
+}
+
+// ReadMissingList reads a missing list written by a receiver, verifying it
+// with the shared secret of conf
+func ReadMissingList(file string, conf *Config) (*MissingList, error) {
+	err := checkMacSecret(conf, "missing lists")
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parseMissingList(data, conf.HMACSecret)
+}
+
+// SendMissing resends the files of dir in the missing list, as a resend of
+// the manifest session the list was written for
+func (s *Sender) SendMissing(ctx context.Context, dir string, list *MissingList) error {
+	dir = path.Clean(dir)
+	id, err := s.senderId()
+	if err != nil {
+		return err
+	}
+	if list.Sender != id {
+		return errors.New("Missing list is for sender " + list.Sender + ", not " + id)
+	}
+
+	manifest, err := generateManifest(dir)
+	if err != nil {
+		return err
+	}
+	wanted := map[string]bool{}
+	for _, p := range list.Files {
+		wanted[p] = true
+	}
+	files := []FileRecord{}
+	for _, f := range manifest.files {
+		if wanted[f.path] {
+			files = append(files, f)
+			delete(wanted, f.path)
+		}
+	}
+	gone := []string{}
+	for p := range wanted {
+		gone = append(gone, p)
+	}
+	sort.Strings(gone)
+	for _, p := range gone {
+		s.log.Error("File of missing list not found", "manifest", hexId(list.Manifest), "path", p)
+	}
+	if len(files) == 0 {
+		return errors.New("No files of the missing list found in " + dir)
+	}
+	manifest.files = files
+	manifest.features = FEATURE_RESEND
+	manifest.originId = list.Manifest
+	manifest.originTimestamp = list.Created
+	s.log.Info("Resending missing files", "manifest", hexId(list.Manifest), "files", len(files))
+	return s.send(ctx, dir, manifest)
+}
@@ -0,0 +1,118 @@
+package godiode
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMissingListTampered(t *testing.T) {
+	l := &MissingList{Manifest: 0xbeef, Created: 1600000000000, Sender: "plant \"a\"", Files: []string{"a b.txt", "日本語/x"}}
+	data := l.marshal("secret")
+	parsed, err := parseMissingList(data, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, l) {
+		t.Fatalf("parsed %+v, expected %+v", parsed, l)
+	}
+	if _, err := parseMissingList(data, "other secret"); err == nil {
+		t.Error("accepted list with the wrong secret")
+	}
+	tampered := bytes.Replace(data, []byte("a b.txt"), []byte("../etc"), 1)
+	if _, err := parseMissingList(tampered, "secret"); err == nil {
+		t.Error("accepted tampered list")
+	}
+	forged := (&MissingList{Sender: "x", Files: []string{"../etc/passwd"}}).marshal("secret")
+	if _, err := parseMissingList(forged, "secret"); err == nil {
+		t.Error("accepted path outside of the dir")
+	}
+}
+
+func TestMissingListSecretRequired(t *testing.T) {
+	conf := testConfig(t)
+	conf.HMACSecret = ""
+	conf.SignatureMode = SIGNATURE_ED25519
+	file := filepath.Join(t.TempDir(), "missing.txt")
+	data := (&MissingList{Sender: "x", Files: []string{"a.txt"}}).marshal("")
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadMissingList(file, conf); err == nil {
+		t.Error("accepted missing list without a secret")
+	}
+}
+
+func TestSendMissing(t *testing.T) {
+	conf := testConfig(t)
+	conf.Receiver.ReportDir = t.TempDir()
+	src := t.TempDir()
+	dst := t.TempDir()
+	tree := testTree()
+	writeTree(t, src, tree)
+	// a dir in the way fails the commit of top.txt
+	err := os.MkdirAll(path.Join(dst, "top.txt", "blocker"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := NewMemoryNetwork(Impairment{})
+	r := startReceiver(t, conf, n.Listen(), dst)
+	send(t, conf, n.Dial(), src)
+	r.waitReceived(t, len(tree)-1)
+	select {
+	case e := <-r.failed:
+		if e.Path != "top.txt" {
+			t.Fatalf("failed to receive %s", e.Path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no failed file")
+	}
+	r.stop()
+
+	lists, _ := filepath.Glob(path.Join(conf.Receiver.ReportDir, "missing-*.txt"))
+	if len(lists) != 1 {
+		t.Fatalf("%d missing lists", len(lists))
+	}
+	list, err := ReadMissingList(lists[0], conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(list.Files, []string{"top.txt"}) {
+		t.Fatalf("missing %v", list.Files)
+	}
+
+	os.RemoveAll(path.Join(dst, "top.txt"))
+	n = NewMemoryNetwork(Impairment{})
+	r = startReceiver(t, conf, n.Listen(), dst)
+	s, err := NewSender(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Transport = n.Dial()
+	err = s.SendMissing(context.Background(), src, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.waitReceived(t, 1)
+	r.stop()
+	assertTreesEqual(t, src, dst)
+
+	reports := readReports(t, conf.Receiver.ReportDir)
+	if len(reports) != 1 || reports[0].Received != len(tree) || reports[0].Failed != 0 || len(reports[0].Files) != len(tree) {
+		t.Fatalf("unexpected reports %+v", reports)
+	}
+	if _, err := os.Stat(lists[0]); err == nil {
+		t.Error("missing list kept after all files were received")
+	}
+
+	list.Sender = "other"
+	if err := s.SendMissing(context.Background(), src, list); err == nil {
+		t.Error("resent the missing list of another sender")
+	}
+}
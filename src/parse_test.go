@@ -0,0 +1,219 @@
+package godiode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+)
+
+// nopSigner accepts everything, so the fuzzer gets past signature checks
+type nopSigner struct{}
+
+func (nopSigner) size() int                     { return 0 }
+func (nopSigner) sign(data []byte) []byte       { return nil }
+func (nopSigner) verify(data, sig []byte) error { return nil }
+
+func testManifest(t testing.TB) []byte {
+	m := Manifest{
+		senderId:  "sender",
+		timestamp: 1600000000000,
+		sequence:  42,
+		dirs:      []DirRecord{{"a", 1}, {"a/b", 2}},
+		files:     []FileRecord{{DirRecord{"a/b/c.txt", 3}, 1234}, {DirRecord{"日本語.txt", 4}, 0}},
+	}
+	data, err := m.serializeManifest(nopSigner{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDeserializeManifestInvalid(t *testing.T) {
+	valid := testManifest(t)
+	// offset of the dir count, after the sender id, timestamp, sequence and features
+	counts := 1 + len("sender") + 8 + 8 + 4
+	withCounts := func(dirs, files uint32) []byte {
+		data := append([]byte{}, valid...)
+		binary.BigEndian.PutUint32(data[counts:], dirs)
+		binary.BigEndian.PutUint32(data[counts+4:], files)
+		return data
+	}
+	withPath := func(p string) []byte {
+		m := Manifest{files: []FileRecord{{DirRecord{p, 0}, 1}}}
+		data, _ := m.serializeManifest(nopSigner{})
+		return data
+	}
+	tests := map[string][]byte{
+		"empty":         {},
+		"truncated":     valid[:len(valid)-1],
+		"trailing":      append(append([]byte{}, valid...), 0),
+		"huge counts":   withCounts(0xFFFFFFFF, 0xFFFFFFFF),
+		"extra dir":     withCounts(3, 2),
+		"extra file":    withCounts(2, 3),
+		"sender id":     append([]byte{0xFF}, valid[1:]...),
+		"parent path":   withPath("../etc/passwd"),
+		"nested parent": withPath("a/../../b"),
+		"absolute path": withPath("/etc/passwd"),
+		"empty path":    withPath(""),
+		"nul in path":   withPath("a\x00b"),
+	}
+	neg := Manifest{files: []FileRecord{{DirRecord{"a", 0}, -1}}}
+	tests["negative size"], _ = neg.serializeManifest(nopSigner{})
+	for name, data := range tests {
+		if _, err := deserializeManifest(data, nopSigner{}); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func FuzzDeserializeManifest(f *testing.F) {
+	valid := testManifest(f)
+	f.Add(valid)
+	f.Add(valid[:len(valid)/2])
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := deserializeManifest(data, nopSigner{})
+		if err != nil {
+			return
+		}
+		for _, f := range m.files {
+			if checkManifestPath(f.path) != nil || f.size < 0 {
+				t.Fatalf("accepted invalid file record %q %d", f.path, f.size)
+			}
+		}
+		out, err := m.serializeManifest(nopSigner{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Fatalf("manifest does not round trip")
+		}
+	})
+}
+
+func FuzzParseFileStart(f *testing.F) {
+	pkt := make([]byte, FILE_START_SIZE)
+	pkt[0] = 0x02
+	pkt[1] = FILE_TYPE_REGULAR | ENCODING_GZIP
+	binary.BigEndian.PutUint32(pkt[2:], 1)
+	binary.BigEndian.PutUint32(pkt[6:], 2)
+	binary.BigEndian.PutUint64(pkt[10:], 1000)
+	pkt[26] = 32
+	pkt[27] = 4
+	binary.BigEndian.PutUint32(pkt[28:], 1400)
+	pkt[32] = 16
+	f.Add(pkt)
+	f.Add(pkt[:FILE_START_SIZE-1])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		st, err := parseFileStart(data, nopSigner{})
+		if err != nil {
+			return
+		}
+		if st.chunkSize < 1 || checkPacketMacSize(st.macSize) != nil {
+			t.Fatalf("accepted invalid file start %+v", st)
+		}
+	})
+}
+
+func FuzzParseFileComplete(f *testing.F) {
+	pkt := make([]byte, FILE_COMPLETE_SIZE)
+	pkt[0] = 0x03
+	f.Add(pkt)
+	f.Add(pkt[:FILE_COMPLETE_SIZE-1])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c, err := parseFileComplete(data, nopSigner{})
+		if err != nil {
+			return
+		}
+		if len(c.hash) != 32 {
+			t.Fatalf("hash of %d bytes", len(c.hash))
+		}
+	})
+}
+
+func TestPacketReaderSkipsForeignPackets(t *testing.T) {
+	conf := DefaultConfig()
+	n := NewMemoryNetwork(Impairment{})
+	l := n.Listen()
+	d := n.Dial()
+	d.WritePacket([]byte("stray traffic"))
+	d.WritePacket([]byte{PROTOCOL_MAGIC >> 8, PROTOCOL_MAGIC & 0xFF, PROTOCOL_VERSION + 1, 0x01})
+	d.WritePacket([]byte{PROTOCOL_MAGIC >> 8, PROTOCOL_MAGIC & 0xFF, PROTOCOL_VERSION})
+	c := &senderConn{Transport: d, metrics: NewMetrics()}
+	c.WritePacket([]byte{0x05, 1, 2, 3})
+
+	pkt, err := newPacketReader(&conf, l, &Logger{out: ioutil.Discard}, NewMetrics()).read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pkt, []byte{0x05, 1, 2, 3}) {
+		t.Fatalf("read %x", pkt)
+	}
+}
+
+func TestUnsupportedFeaturesRejected(t *testing.T) {
+	conf := DefaultConfig()
+	m := Manifest{features: SUPPORTED_FEATURES + 1, files: []FileRecord{{DirRecord{"a", 0}, 1}}}
+	data, err := m.serializeManifest(nopSigner{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := fileReceiver{conf: &conf, log: &Logger{out: ioutil.Discard}, metrics: NewMetrics(), verifier: nopSigner{}, sessions: map[int]*fileSession{}}
+	err = r.onManifestData(1, data)
+	if err == nil || len(r.sessions) > 0 {
+		t.Fatal("accepted manifest with unsupported features")
+	}
+}
+
+func TestForgedPacketsKeepNoSessionAlive(t *testing.T) {
+	v := newHmacSigner("secret")
+	s := &fileSession{log: &Logger{out: ioutil.Discard}, metrics: NewMetrics(), verifier: v, manifest: &Manifest{}, manifestId: 1}
+	start := make([]byte, FILE_START_SIZE+v.size())
+	start[0] = 0x02
+	binary.BigEndian.PutUint32(start[2:], 1)
+	complete := make([]byte, FILE_COMPLETE_SIZE+v.size())
+	complete[0] = 0x03
+	if s.onFileTransferStart(start, len(start)) == nil || s.onFileTransferComplete(complete, len(complete)) == nil {
+		t.Fatal("accepted forged packets")
+	}
+	if !s.lastSeen.IsZero() {
+		t.Error("forged packets kept the session alive")
+	}
+	copy(complete[FILE_COMPLETE_SIZE:], v.sign(complete[:FILE_COMPLETE_SIZE]))
+	s.onFileTransferComplete(complete, len(complete))
+	if s.lastSeen.IsZero() {
+		t.Error("signed packet did not keep the session alive")
+	}
+}
+
+func TestManifestIdCollision(t *testing.T) {
+	conf := DefaultConfig()
+	manifestPacket := func(sender string) ([]byte, []byte) {
+		m := Manifest{senderId: sender, sequence: 1, files: []FileRecord{{DirRecord{"a", 0}, 1}}}
+		data, err := m.serializeManifest(nopSigner{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkt := make([]byte, 11, 11+len(data))
+		pkt[0] = 0x01
+		binary.BigEndian.PutUint32(pkt[1:], 1)
+		binary.BigEndian.PutUint32(pkt[7:], uint32(len(data)))
+		return data, append(pkt, data...)
+	}
+	raw, repeat := manifestPacket("a")
+	_, other := manifestPacket("b")
+	s := &fileSession{manifest: &Manifest{senderId: "a"}, manifestId: 1, rawManifest: raw}
+	r := fileReceiver{conf: &conf, log: &Logger{out: ioutil.Discard}, metrics: NewMetrics(), verifier: nopSigner{}, sessions: map[int]*fileSession{1: s}, manifests: map[int]*PendingManifestTransfer{}}
+	for _, pkt := range [][]byte{repeat, other, other, repeat} {
+		if err := r.onManifestPacket(pkt, len(pkt)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r.sessions[1] != s {
+		t.Error("session replaced by a manifest with the same id")
+	}
+	if n := r.metrics.manifestCollisions.get(); n != 1 {
+		t.Errorf("counted %d collisions, expected 1", n)
+	}
+}
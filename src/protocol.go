@@ -0,0 +1,120 @@
+package godiode
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+/**
+ * Protocol header
+ *
+ * Every packet starts with a header identifying the protocol, followed by the
+ * packet type and payload, see sender.go.
+ *
+ * | magic | version | type | payload... |
+ * magic - uint16 - 0x4744 ("GD")
+ * version - uint8 - protocol version, packets of other versions are ignored
+ *
+ * The version is bumped on incompatible changes of any packet format. Optional
+ * features of a manifest session are advertised in the manifest instead, see
+ * manifest.go.
+ */
+
+const PROTOCOL_MAGIC = 0x4744
+const PROTOCOL_VERSION = 2
+const PROTOCOL_HEADER_SIZE = 2 + 1
+
+// manifest feature flags
+const (
+	FEATURE_COMPRESSION = 0x01
+	FEATURE_ENCRYPTION  = 0x02
+	FEATURE_FEC         = 0x04
+	FEATURE_RESEND      = 0x08
+
+	SUPPORTED_FEATURES = FEATURE_COMPRESSION | FEATURE_ENCRYPTION | FEATURE_FEC | FEATURE_RESEND
+)
+
+// maxPayload returns the max size of a packet without the protocol header
+func maxPayload(conf *Config) int {
+	return conf.MaxPacketSize - PROTOCOL_HEADER_SIZE
+}
+
+// WritePacket sends pkt with the protocol header
+func (c *senderConn) WritePacket(pkt []byte) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	c.wbuff = append(c.wbuff[:0], PROTOCOL_MAGIC>>8, PROTOCOL_MAGIC&0xFF, PROTOCOL_VERSION)
+	c.wbuff = append(c.wbuff, pkt...)
+	c.metrics.txPackets.add(1)
+	c.metrics.txBytes.add(uint64(len(c.wbuff)))
+	c.sent.add(uint64(len(c.wbuff)))
+	return c.Transport.WritePacket(c.wbuff)
+}
+
+// packetReader reads packets of this protocol version from a transport
+type packetReader struct {
+	t        Transport
+	buff     []byte
+	versions map[byte]bool
+	log      *Logger
+	metrics  *Metrics
+	// handles heartbeats if set, see heartbeat.go
+	health *healthMonitor
+}
+
+func newPacketReader(conf *Config, t Transport, log *Logger, m *Metrics) *packetReader {
+	return &packetReader{t: t, buff: make([]byte, conf.MaxPacketSize), versions: map[byte]bool{}, log: log, metrics: m}
+}
+
+// read returns the next packet without the protocol header. Foreign traffic is
+// skipped, and so are packets of other protocol versions after reporting the
+// version once. Heartbeats are handed to the health monitor if set.
+func (r *packetReader) read() ([]byte, error) {
+	for {
+		read, err := r.t.ReadPacket(r.buff)
+		if err != nil {
+			return nil, err
+		}
+		if read < PROTOCOL_HEADER_SIZE+1 || binary.BigEndian.Uint16(r.buff) != PROTOCOL_MAGIC {
+			continue
+		}
+		v := r.buff[2]
+		if v != PROTOCOL_VERSION {
+			if !r.versions[v] {
+				r.versions[v] = true
+				r.log.Warn("Ignoring packets of unsupported protocol version", "version", v, "supported", PROTOCOL_VERSION)
+			}
+			continue
+		}
+		r.metrics.received(r.buff[PROTOCOL_HEADER_SIZE], read)
+		if r.buff[PROTOCOL_HEADER_SIZE] == 0x00 && r.health != nil {
+			err = r.health.onHeartbeat(r.buff[PROTOCOL_HEADER_SIZE:read])
+			if err != nil {
+				r.log.warnErr("Rejected heartbeat", err)
+			}
+			continue
+		}
+		return r.buff[PROTOCOL_HEADER_SIZE:read], nil
+	}
+}
+
+// featureNames describes manifest feature flags
+func featureNames(features uint32) string {
+	names := ""
+	for _, f := range []struct {
+		flag uint32
+		name string
+	}{{FEATURE_COMPRESSION, "compression"}, {FEATURE_ENCRYPTION, "encryption"}, {FEATURE_FEC, "fec"}, {FEATURE_RESEND, "resend"}} {
+		if features&f.flag != 0 {
+			names += " " + f.name
+			features &^= f.flag
+		}
+	}
+	if features != 0 {
+		names += " 0x" + strconv.FormatUint(uint64(features), 16)
+	}
+	if names == "" {
+		return "none"
+	}
+	return names[1:]
+}
@@ -0,0 +1,339 @@
+package godiode
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// packets buffered per connection while the upstream connects or is slow
+const PROXY_BUFFER_PACKETS = 4096
+
+/**
+ * TCP proxy
+ *
+ * Every connection accepted by the proxy sender is sent as its own stream, see
+ * stream.go. Idle connections send empty keepalive packets. The proxy receiver
+ * opens a connection to the upstream for every new stream and closes it at the
+ * end of the stream. On packet loss, or when nothing was received for the
+ * stream timeout, the upstream connection is reset instead.
+ */
+
+// Proxy accepts TCP connections and sends each of them as a stream. When ctx
+// is done the open connections are closed before it returns.
+func (s *Sender) Proxy(ctx context.Context) error {
+	conf := s.conf
+	if conf.Proxy.Listen == "" {
+		return errors.New("Proxy listen address required")
+	}
+	if conf.StreamTimeout < 1 {
+		return errors.New("Invalid stream timeout")
+	}
+	if err := checkMacSecret(conf, "proxies"); err != nil {
+		return err
+	}
+	c, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	// open connections, reported in heartbeats
+	var open counter
+	stopHeartbeats, err := s.startHeartbeats(c, open.get)
+	if err != nil {
+		return err
+	}
+	defer stopHeartbeats()
+	// accepted connections, closed and waited for before returning
+	conns := map[net.Conn]bool{}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	defer func() {
+		lock.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		lock.Unlock()
+		wg.Wait()
+	}()
+
+	ln, err := net.Listen("tcp", conf.Proxy.Listen)
+	if err != nil {
+		return errors.New("Failed to listen for proxy connections: " + err.Error())
+	}
+	defer ln.Close()
+	defer closeOnDone(ctx, ln)()
+	s.log.Info("Proxying connections", "listen", ln.Addr().String())
+	for {
+		conn, err := ln.Accept()
+		if ctx.Err() != nil {
+			if err == nil {
+				conn.Close()
+			}
+			return ctx.Err()
+		}
+		if err != nil {
+			return errors.New("Failed to accept proxy connection: " + err.Error())
+		}
+		w, err := newStreamWriter(conf, c)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		open.add(1)
+		lock.Lock()
+		conns[conn] = true
+		lock.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			proxyConnection(ctx, conf, s.log, conn, w)
+			lock.Lock()
+			delete(conns, conn)
+			lock.Unlock()
+			// decrement
+			open.add(^uint64(0))
+		}()
+	}
+}
+
+// proxyConnection sends everything read from conn as a stream. A connection
+// closed when ctx is done is not ended, the receiver resets its upstream
+// connection once the stream times out.
+func proxyConnection(ctx context.Context, conf *Config, log *Logger, conn net.Conn, w *streamWriter) {
+	defer conn.Close()
+	id := hexId(w.id)
+	log.Info("Accepted connection", "stream", id, "remote", conn.RemoteAddr().String())
+	keepalive := time.Duration(conf.StreamTimeout) * time.Second / 3
+	buff := make([]byte, w.chunkSize())
+	sent := uint64(0)
+	for {
+		conn.SetReadDeadline(time.Now().Add(keepalive))
+		read, err := conn.Read(buff)
+		if read > 0 {
+			_, werr := w.Write(buff[:read])
+			if werr != nil {
+				log.Error("Failed to send stream", "stream", id, "err", werr)
+				return
+			}
+			sent += uint64(read)
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			err = w.keepalive()
+			if err != nil {
+				log.Error("Failed to send stream", "stream", id, "err", err)
+				return
+			}
+			continue
+		}
+		if ctx.Err() != nil {
+			log.Warn("Interrupted stream", "stream", id, "sent", sent)
+			return
+		}
+		if err != nil {
+			break
+		}
+	}
+	err := w.Close()
+	if err != nil {
+		log.Error("Failed to send stream", "stream", id, "err", err)
+		return
+	}
+	log.Info("Closed stream", "stream", id, "sent", sent)
+}
+
+// upstreamWriter hands written data to the upstream connection without
+// blocking the receive loop. The abort flag is kept outside of the data
+// channel, so it is not lost when the channel is full.
+type upstreamWriter struct {
+	data    chan []byte
+	aborted int32
+}
+
+func newUpstreamWriter() *upstreamWriter {
+	return &upstreamWriter{data: make(chan []byte, PROXY_BUFFER_PACKETS)}
+}
+
+func (w *upstreamWriter) Write(p []byte) (int, error) {
+	select {
+	case w.data <- append([]byte{}, p...):
+		return len(p), nil
+	default:
+		return 0, errors.New("upstream too slow")
+	}
+}
+
+// close ends the stream, with abort the upstream connection is reset instead
+// of closed
+func (w *upstreamWriter) close(abort bool) {
+	if abort {
+		atomic.StoreInt32(&w.aborted, 1)
+	}
+	close(w.data)
+}
+
+func (w *upstreamWriter) isAborted() bool {
+	return atomic.LoadInt32(&w.aborted) != 0
+}
+
+type proxyStream struct {
+	s        *streamReassembler
+	data     *upstreamWriter
+	lastSeen time.Time
+}
+
+func proxyUpstream(conf *Config, log *Logger, id string, w *upstreamWriter) {
+	drain := func() {
+		for range w.data {
+		}
+	}
+	conn, err := net.DialTimeout("tcp", conf.Proxy.Upstream, time.Duration(conf.StreamTimeout)*time.Second)
+	if err != nil {
+		log.Error("Failed to connect stream to upstream", "stream", id, "err", err)
+		drain()
+		return
+	}
+	defer conn.Close()
+	log.Info("Connected stream", "stream", id, "upstream", conn.RemoteAddr().String())
+	reset := func() {
+		// incomplete stream, reset the connection
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetLinger(0)
+		}
+		drain()
+	}
+	for d := range w.data {
+		if w.isAborted() {
+			reset()
+			return
+		}
+		_, err = conn.Write(d)
+		if err != nil {
+			log.Error("Failed to write stream to upstream", "stream", id, "err", err)
+			reset()
+			return
+		}
+	}
+	if w.isAborted() {
+		reset()
+	}
+}
+
+// Proxy connects every stream received to the upstream
+func (r *Receiver) Proxy(ctx context.Context) error {
+	conf := r.conf
+	if conf.Proxy.Upstream == "" {
+		return errors.New("Proxy upstream address required")
+	}
+	if conf.StreamTimeout < 1 {
+		return errors.New("Invalid stream timeout")
+	}
+	if err := checkMacSecret(conf, "proxies"); err != nil {
+		return err
+	}
+	c, err := r.listen()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	defer interruptOnDone(ctx, c)()
+
+	replay, err := newReplayGuard(conf.StateFile, conf.Receiver.MaxClockSkew)
+	if err != nil {
+		return err
+	}
+	timeout := time.Duration(conf.StreamTimeout) * time.Second
+	o := newStreamOpener(conf, r.metrics)
+	streams := map[uint32]*proxyStream{}
+	closed := map[uint32]time.Time{}
+	closeStream := func(id uint32, ps *proxyStream, abort bool) {
+		ps.data.close(abort)
+		delete(streams, id)
+		closed[id] = time.Now()
+	}
+	lastSweep := time.Now()
+	packets := newPacketReader(conf, c, r.log, r.metrics)
+	stopHealth, err := r.monitorHealth(packets, nil)
+	if err != nil {
+		return err
+	}
+	defer stopHealth()
+	for {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		buff, err := packets.read()
+		read := len(buff)
+		if ctx.Err() != nil {
+			for id, ps := range streams {
+				closeStream(id, ps, true)
+			}
+			return ctx.Err()
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			read = 0
+		} else if err != nil {
+			return errors.New("Failed to recv data: " + err.Error())
+		}
+
+		if time.Since(lastSweep) > time.Second {
+			lastSweep = time.Now()
+			for id, ps := range streams {
+				if time.Since(ps.lastSeen) > timeout {
+					r.log.Warn("Stream timed out", "stream", hexId(id))
+					closeStream(id, ps, true)
+				}
+			}
+			for id, t := range closed {
+				if time.Since(t) > timeout {
+					delete(closed, id)
+				}
+			}
+		}
+
+		if read < 1 || buff[0] != 0x05 {
+			continue
+		}
+		p, err := o.open(buff, read)
+		if err != nil {
+			r.log.warnErr("Rejected stream packet", err)
+			continue
+		}
+		if _, exists := closed[p.id]; exists {
+			continue
+		}
+		id := hexId(p.id)
+		ps := streams[p.id]
+		if ps == nil {
+			if joinedLate(p.seq, conf.Receiver.ReorderWindow) {
+				// joined in the middle of the stream, the start is lost
+				r.log.Warn("Ignoring stream joined after its start", "stream", id, "seq", p.seq)
+				closed[p.id] = time.Now()
+				continue
+			}
+			err = replay.acceptStream(p.id, p.timestamp)
+			if err != nil {
+				r.log.warnErr("Rejected stream", err)
+				closed[p.id] = time.Now()
+				continue
+			}
+			data := newUpstreamWriter()
+			s := newStreamReassembler(p.id, data, conf.Receiver.ReorderWindow, r.log)
+			s.strict = true
+			ps = &proxyStream{s: s, data: data}
+			streams[p.id] = ps
+			go proxyUpstream(conf, r.log, id, data)
+		}
+		ps.lastSeen = time.Now()
+		err = ps.s.push(p)
+		if err != nil {
+			r.log.Warn("Aborting stream", "stream", id, "reason", err)
+			r.metrics.outOfOrderAborts.add(1)
+			closeStream(p.id, ps, true)
+		} else if ps.s.eof {
+			r.log.Info("Received stream", "stream", id, "size", ps.s.written)
+			closeStream(p.id, ps, false)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package godiode
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProxyUpstreamAbort(t *testing.T) {
+	for _, abort := range []bool{false, true} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf := DefaultConfig()
+		conf.Logger = &Logger{out: ioutil.Discard}
+		conf.Proxy.Upstream = ln.Addr().String()
+
+		w := newUpstreamWriter()
+		// fill the buffer, the abort must not depend on a free slot
+		for i := 0; i < PROXY_BUFFER_PACKETS; i++ {
+			_, err = w.Write([]byte("data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err = w.Write([]byte("data")); err == nil {
+			t.Fatal("wrote to a full buffer")
+		}
+		w.close(abort)
+		go proxyUpstream(&conf, conf.Logger, "test", w)
+
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.Copy(ioutil.Discard, conn)
+		conn.Close()
+		ln.Close()
+		if abort && err == nil {
+			t.Error("aborted stream closed without reset")
+		}
+		if !abort && err != nil {
+			t.Errorf("complete stream reset: %v", err)
+		}
+	}
+}
+
+type testProxy struct {
+	conf     *Config
+	upstream net.Listener
+	cancel   context.CancelFunc
+	sent     chan error
+	received chan error
+	stopOnce sync.Once
+}
+
+// startProxy runs a proxy sender and receiver over a memory network
+func startProxy(t *testing.T, conf *Config) *testProxy {
+	t.Helper()
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { up.Close() })
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Proxy.Listen = ln.Addr().String()
+	ln.Close()
+	conf.Proxy.Upstream = up.Addr().String()
+	conf.Sender.HeartbeatInterval = 0
+
+	n := NewMemoryNetwork(Impairment{})
+	r, err := NewReceiver(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Transport = n.Listen()
+	s, err := NewSender(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Transport = n.Dial()
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &testProxy{conf: conf, upstream: up, cancel: cancel, sent: make(chan error, 1), received: make(chan error, 1)}
+	go func() { p.received <- r.Proxy(ctx) }()
+	go func() { p.sent <- s.Proxy(ctx) }()
+	t.Cleanup(p.stop)
+	return p
+}
+
+// dial connects to the proxy sender once it listens
+func (p *testProxy) dial(t *testing.T) net.Conn {
+	t.Helper()
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", p.conf.Proxy.Listen)
+		if err == nil {
+			return conn
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// accept reads the next upstream connection to its end
+func (p *testProxy) accept(t *testing.T) string {
+	t.Helper()
+	p.upstream.(*net.TCPListener).SetDeadline(time.Now().Add(10 * time.Second))
+	conn, err := p.upstream.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func (p *testProxy) stop() {
+	p.stopOnce.Do(func() {
+		p.cancel()
+		<-p.sent
+		<-p.received
+	})
+}
+
+func TestProxy(t *testing.T) {
+	for _, window := range []int{0, 128} {
+		conf := testConfig(t)
+		conf.Receiver.ReorderWindow = window
+		p := startProxy(t, conf)
+		conn := p.dial(t)
+		if _, err := conn.Write([]byte("proxied")); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if data := p.accept(t); data != "proxied" {
+			t.Errorf("reorder window %d: upstream received %q", window, data)
+		}
+		p.stop()
+	}
+}
+
+func TestProxyCancelClosesConnections(t *testing.T) {
+	p := startProxy(t, testConfig(t))
+	conn := p.dial(t)
+	defer conn.Close()
+	if _, err := conn.Write([]byte("open")); err != nil {
+		t.Fatal(err)
+	}
+	p.upstream.(*net.TCPListener).SetDeadline(time.Now().Add(10 * time.Second))
+	up, err := p.upstream.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	if _, err = io.ReadFull(up, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		p.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy still running")
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection not closed: %v", err)
+	}
+}
@@ -1,94 +1,526 @@
-package main
+package godiode
 
 import (
 	"bytes"
-	"io"
+	"context"
 	"io/fs"
 	"path/filepath"
 	"strings"
 
 	//	"flag"
-	"crypto/hmac"
 	"crypto/sha256"
-	"crypto/sha512"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
-	"fmt"
 	"hash"
-	"log"
 	"math"
 	"net"
 	"os"
 	"path"
+	"sort"
 	"strconv"
+	"sync"
 	"time"
 )
 
 type PendingManifestTransfer struct {
-	buff   []byte
-	offset int
-	index  int
+	buff     []byte
+	offset   int
+	index    int
+	lastSeen time.Time
 }
 
 type PendingFileTransfer struct {
 	size          uint64
 	offset        uint64
-	index         uint8
 	rawSize       uint64
 	hash          hash.Hash
 	file          *os.File
 	transferStart time.Time
 	err           *error
 	filename      string
+	path          string
 	fileIndex     int
 	modts         uint32
+	contentSize   int64
+	encoding      byte
+	tmpFilename   string
+	chunkSize     int
+	packets       uint64
+	received      []uint64
+	fec           *fecCodec
+	repairs       map[uint64][][]byte
+	mac           *packetMac
+	window        []reorderSlot
+	next          uint64
+	declared      uint64
+	// resumed by a later round, its losses were counted in the first one
+	resumed    bool
+	reordered  uint64
+	duplicated uint64
+	dropped    uint64
+	recovered  uint64
+	forged     uint64
 }
 
-type Receiver struct {
-	conf                    *Config
-	dir                     string
-	tmpDir                  string
-	manifest                *Manifest
-	manifestId              int
-	lastManifestId          int
-	pendingFileTransfer     *PendingFileTransfer
-	pendingManifestTransfer *PendingManifestTransfer
+// early data packet kept in memory until the hash catches up
+type reorderSlot struct {
+	n    uint64
+	data []byte
 }
 
-func (r *Receiver) onFileTransferData(buff []byte, read int) error {
-	pt := r.pendingFileTransfer
-	if pt == nil || read < 1 || pt.err != nil {
-		return nil
+type fileTransferKey struct {
+	manifestId int
+	fileIndex  int
+}
+
+// sessions and pending manifests are dropped when idle for this long
+const SESSION_TIMEOUT = 5 * time.Minute
+
+// max manifests received concurrently, the oldest is dropped beyond it
+const MAX_PENDING_MANIFESTS = 16
+
+// fileReceiver receives the manifest sessions of all senders, dispatching
+// packets to the session of their manifest id
+type fileReceiver struct {
+	conf     *Config
+	log      *Logger
+	metrics  *Metrics
+	verifier verifier
+	replay   *replayGuard
+	dir      string
+	tmpDir   string
+	// manifests being received, by manifest id
+	manifests map[int]*PendingManifestTransfer
+	sessions  map[int]*fileSession
+	lastSweep time.Time
+	plain     []byte
+	journal   *journal
+	commits   *committer
+	// callbacks of the Receiver
+	onReceived func(FileEvent)
+	onFailed   func(FileEvent)
+}
+
+// fileSession is the state of a single manifest session of a sender
+type fileSession struct {
+	conf     *Config
+	log      *Logger
+	metrics  *Metrics
+	verifier verifier
+	// dir the files of the session are written to
+	dir string
+	// dir receives the files of other senders too
+	sharedDir           bool
+	tmpDir              string
+	manifest            *Manifest
+	manifestId          int
+	pendingFileTransfer *PendingFileTransfer
+	// partially received files, kept to be completed by later rounds
+	partialTransfers   map[fileTransferKey]*PendingFileTransfer
+	completedTransfers map[fileTransferKey]bool
+	// verified files being moved into place, completed once moved
+	movingTransfers map[fileTransferKey]bool
+	commits         *committer
+	// session cipher if encryption is enabled
+	cipher *sessionCipher
+	// manifest as received, repeats of it are not decoded again
+	rawManifest []byte
+	// another manifest with the id of the session was received, reported once
+	collided bool
+	// last authenticated packet, forged packets do not keep a session alive
+	lastSeen time.Time
+	status   *transferStatus
+	journal  *journal
+	// callbacks of the Receiver
+	onReceived func(FileEvent)
+	onFailed   func(FileEvent)
+}
+
+// fileFields identifies a file of the session in log events
+func (s *fileSession) fileFields(pt *PendingFileTransfer, fields ...interface{}) []interface{} {
+	return append([]interface{}{"manifest", hexId(uint32(s.manifestId)), "sender", s.manifest.senderId, "file", pt.fileIndex, "path", pt.path}, fields...)
+}
+
+// fileFailed reports a failed transfer, fields are added to the log event
+func (s *fileSession) fileFailed(pt *PendingFileTransfer, err error, fields ...interface{}) {
+	s.log.Error("Failed to receive file", s.fileFields(pt, append([]interface{}{"reason", err}, fields...)...)...)
+	s.status.update(pt.fileIndex, FILE_STATUS_FAILED, "", err.Error())
+	if s.onFailed != nil {
+		s.onFailed(FileEvent{Sender: s.manifest.senderId, Path: pt.path, Size: pt.contentSize, Err: err})
 	}
+}
 
-	idx := buff[0] & 0x7F
-	if idx == pt.index {
-		//check out of order packets
-		if pt.offset+uint64(read-1) > pt.size {
-			err := errors.New("Received too much data on file")
-			pt.err = &err
-			pt.file.Close()
-			os.Remove(pt.filename)
-			return err
+func (s *fileSession) abortFileTransfer(pt *PendingFileTransfer, err error) error {
+	pt.err = &err
+	pt.file.Close()
+	os.Remove(pt.tmpFilename)
+	return err
+}
+
+// suspendFileTransfer keeps the received parts of an incomplete file for the
+// next transmission round
+func (s *fileSession) suspendFileTransfer(pt *PendingFileTransfer) {
+	if pt.err != nil {
+		return
+	}
+	pt.file.Close()
+	s.partialTransfers[fileTransferKey{s.manifestId, pt.fileIndex}] = pt
+}
+
+// discardPartialTransfers drops all state kept from previous rounds
+func (s *fileSession) discardPartialTransfers() {
+	if s.pendingFileTransfer != nil {
+		s.abortFileTransfer(s.pendingFileTransfer, errors.New("Session expired"))
+		s.pendingFileTransfer = nil
+	}
+	for k, pt := range s.partialTransfers {
+		os.Remove(pt.tmpFilename)
+		delete(s.partialTransfers, k)
+	}
+	s.completedTransfers = map[fileTransferKey]bool{}
+}
+
+func (pt *PendingFileTransfer) hasPacket(n uint64) bool {
+	return pt.received[n/64]&(1<<(n%64)) != 0
+}
+
+// receivedBytes returns the number of bytes received
+func (pt *PendingFileTransfer) receivedBytes() uint64 {
+	received := uint64(0)
+	for n := uint64(0); n < pt.packets; n++ {
+		if pt.hasPacket(n) {
+			received += uint64(pt.packetLen(n))
+		}
+	}
+	return received
+}
+
+func (pt *PendingFileTransfer) packetLen(n uint64) int {
+	offset := n * uint64(pt.chunkSize)
+	if pt.size-offset < uint64(pt.chunkSize) {
+		return int(pt.size - offset)
+	}
+	return pt.chunkSize
+}
+
+// missing returns the byte ranges of the file not yet received
+func (pt *PendingFileTransfer) missing() [][2]uint64 {
+	ranges := make([][2]uint64, 0)
+	for n := uint64(0); n < pt.packets; n++ {
+		if pt.hasPacket(n) {
+			continue
 		}
-		pt.hash.Write(buff[1:read])
-		pt.file.Write(buff[1:read])
-		pt.index = (pt.index + 1) & 0x7F
-		pt.offset += uint64(read - 1)
-		pt.rawSize += uint64(HEADER_OVERHEAD + read)
-		if pt.offset == uint64(read-1) && r.conf.Verbose {
-			//			fmt.Println("Received first byte of data of " + pt.filename)
+		start := n * uint64(pt.chunkSize)
+		end := start + uint64(pt.packetLen(n))
+		if l := len(ranges); l > 0 && ranges[l-1][1] == start {
+			ranges[l-1][1] = end
+		} else {
+			ranges = append(ranges, [2]uint64{start, end})
+		}
+	}
+	return ranges
+}
+
+/*
+ * file transfer data packet
+ *
+ * type - uint8 - 0x80
+ * manifestSessionId - uint32 - manifest session id
+ * fileIndex - uint32 - file index in the manifest
+ * offset - uint64 - byte offset of the payload in the file
+ * payload - byte[] - file content, chunkSize bytes for all but the last packet
+ * mac - byte[macSize] - truncated hmac-sha256 of this packet, see sign.go
+ */
+func (s *fileSession) onFileTransferData(buff []byte, read int) error {
+	pt := s.pendingFileTransfer
+	if pt == nil || pt.err != nil {
+		return nil
+	}
+	if read < DATA_HEADER_SIZE {
+		return errors.New("Received truncated file transfer data packet")
+	}
+	manifestId := int(binary.BigEndian.Uint32(buff[1:]))
+	fileIndex := int(binary.BigEndian.Uint32(buff[5:]))
+	if manifestId != s.manifestId || fileIndex != pt.fileIndex {
+		return nil
+	}
+	if pt.mac != nil {
+		if read < DATA_HEADER_SIZE+pt.mac.size || !pt.mac.verify(buff[:read-pt.mac.size], buff[read-pt.mac.size:read]) {
+			pt.forged++
+			s.metrics.authFailed(AUTH_MAC)
+			return fieldErr("Invalid data packet MAC", "file", pt.fileIndex, "path", pt.path)
 		}
-		if pt.offset == pt.size {
-			//done, wait for file complete packet
+		read -= pt.mac.size
+	}
+	s.lastSeen = time.Now()
+	offset := binary.BigEndian.Uint64(buff[9:])
+	if offset%uint64(pt.chunkSize) != 0 || offset >= pt.size {
+		return fieldErr("Invalid data packet offset", "file", pt.fileIndex, "path", pt.path, "offset", offset)
+	}
+	n := offset / uint64(pt.chunkSize)
+	if read-DATA_HEADER_SIZE != pt.packetLen(n) {
+		return fieldErr("Invalid data packet size", "file", pt.fileIndex, "path", pt.path, "offset", offset)
+	}
+	pt.rawSize += uint64(HEADER_OVERHEAD + read)
+
+	if pt.hasPacket(n) {
+		pt.duplicated++
+		return nil
+	}
+	if n < pt.next {
+		pt.reordered++
+		if n < pt.declared {
+			// arrived after it was declared lost
+			pt.dropped--
 		}
 	} else {
-		//log.Fatal("Received out of order packet ", ptype&0x7F, pt.index, pt.offset)
-		err := errors.New("Received out of order packet for file transfer")
-		pt.err = &err
+		pt.next = n + 1
+	}
+	err := s.storePacket(pt, n, buff[DATA_HEADER_SIZE:read])
+	if err != nil {
+		return err
+	}
+	s.expireReorderWindow(pt)
+	if pt.fec != nil {
+		s.expireRepairs(pt, pt.next)
+	}
+	return nil
+}
+
+// expireReorderWindow declares packets lost once they are more than the
+// reorder window behind the highest packet received
+func (s *fileSession) expireReorderWindow(pt *PendingFileTransfer) {
+	w := uint64(len(pt.window))
+	if pt.next <= w || pt.resumed {
+		return
+	}
+	pt.declareLost(pt.next - w)
+}
+
+// declareLost counts the packets missing before packet until as dropped
+func (pt *PendingFileTransfer) declareLost(until uint64) {
+	if frontier := pt.offset / uint64(pt.chunkSize); pt.declared < frontier {
+		pt.declared = frontier
+	}
+	for ; pt.declared < until; pt.declared++ {
+		if !pt.hasPacket(pt.declared) {
+			pt.dropped++
+		}
+	}
+}
+
+// expireRepairs drops the repair shards of blocks more than the reorder
+// window behind packet position, missing shards of them are lost
+func (s *fileSession) expireRepairs(pt *PendingFileTransfer, position uint64) {
+	w := uint64(len(pt.window))
+	for b := range pt.repairs {
+		if (b+1)*uint64(pt.fec.k)+w < position {
+			delete(pt.repairs, b)
+		}
+	}
+}
+
+// stats returns the packet statistics of the transfer as log fields
+func (pt *PendingFileTransfer) stats() []interface{} {
+	return []interface{}{"reordered", pt.reordered, "duplicated", pt.duplicated, "dropped", pt.dropped, "recovered", pt.recovered, "forged", pt.forged}
+}
+
+// storePacket writes data packet n to its position in the tmp file
+func (s *fileSession) storePacket(pt *PendingFileTransfer, n uint64, data []byte) error {
+	if pt.hasPacket(n) {
+		return nil
+	}
+	_, err := pt.file.WriteAt(data, int64(n*uint64(pt.chunkSize)))
+	if err != nil {
+		return s.abortFileTransfer(pt, errors.New("Failed to write tmp file: "+err.Error()))
+	}
+	pt.received[n/64] |= 1 << (n % 64)
+
+	if n*uint64(pt.chunkSize) == pt.offset {
+		// hash the contiguous data received so far, early packets are taken
+		// from the reorder window and read back from the tmp file otherwise
+		pt.hash.Write(data)
+		pt.offset += uint64(len(data))
+		var buff []byte
+		for p := pt.offset / uint64(pt.chunkSize); pt.offset < pt.size && pt.hasPacket(p); p++ {
+			l := pt.packetLen(p)
+			if len(pt.window) > 0 && pt.window[p%uint64(len(pt.window))].n == p && pt.window[p%uint64(len(pt.window))].data != nil {
+				pt.hash.Write(pt.window[p%uint64(len(pt.window))].data)
+			} else {
+				if buff == nil {
+					buff = make([]byte, pt.chunkSize)
+				}
+				_, err = pt.file.ReadAt(buff[:l], int64(pt.offset))
+				if err != nil {
+					return s.abortFileTransfer(pt, errors.New("Failed to read tmp file: "+err.Error()))
+				}
+				pt.hash.Write(buff[:l])
+			}
+			pt.offset += uint64(l)
+		}
+	} else if len(pt.window) > 0 && n*uint64(pt.chunkSize) > pt.offset {
+		slot := &pt.window[n%uint64(len(pt.window))]
+		slot.n = n
+		slot.data = append(slot.data[:0], data...)
+	}
+
+	if pt.fec != nil {
+		b := n / uint64(pt.fec.k)
+		if _, exists := pt.repairs[b]; exists {
+			return s.recoverFecBlock(pt, b)
+		}
+	}
+	return nil
+}
+
+/*
+ * file transfer repair packet
+ *
+ * type - uint8 - 0x04
+ * manifestSessionId - uint32 - manifest session id
+ * fileIndex - uint32 - file index in the manifest
+ * block - uint32 - FEC block index
+ * repairIndex - uint8 - index of the repair packet within the block
+ * payload - byte[chunkSize] - reed-solomon repair shard of the block
+ * mac - byte[macSize] - truncated hmac-sha256 of this packet
+ */
+func (s *fileSession) onFileTransferRepair(buff []byte, read int) error {
+	pt := s.pendingFileTransfer
+	if pt == nil || pt.err != nil || pt.fec == nil {
+		return nil
+	}
+	macSize := 0
+	if pt.mac != nil {
+		macSize = pt.mac.size
+	}
+	if read != REPAIR_HEADER_SIZE+pt.chunkSize+macSize {
+		return errors.New("Received repair packet with invalid size")
+	}
+	manifestId := int(binary.BigEndian.Uint32(buff[1:]))
+	fileIndex := int(binary.BigEndian.Uint32(buff[5:]))
+	if manifestId != s.manifestId || fileIndex != pt.fileIndex {
+		return nil
+	}
+	if pt.mac != nil {
+		if !pt.mac.verify(buff[:read-macSize], buff[read-macSize:read]) {
+			pt.forged++
+			s.metrics.authFailed(AUTH_MAC)
+			return fieldErr("Invalid repair packet MAC", "file", pt.fileIndex, "path", pt.path)
+		}
+		read -= macSize
+	}
+	s.lastSeen = time.Now()
+	block := uint64(binary.BigEndian.Uint32(buff[9:]))
+	j := int(buff[13])
+	if j >= pt.fec.m || pt.blockPackets(block) == 0 {
+		return errors.New("Received repair packet with invalid index")
+	}
+	repairs, exists := pt.repairs[block]
+	if !exists {
+		if pt.blockComplete(block) {
+			return nil
+		}
+		repairs = make([][]byte, pt.fec.m)
+		pt.repairs[block] = repairs
+	}
+	if repairs[j] == nil {
+		repairs[j] = make([]byte, pt.chunkSize)
+		copy(repairs[j], buff[REPAIR_HEADER_SIZE:read])
+	}
+	err := s.recoverFecBlock(pt, block)
+	if err != nil {
 		return err
 	}
+	// repairs are sent after the data of their block
+	position := (block + 1) * uint64(pt.fec.k)
+	if pt.next > position {
+		position = pt.next
+	}
+	s.expireRepairs(pt, position)
+	return nil
+}
+
+// number of data packets in FEC block b of the pending file
+func (pt *PendingFileTransfer) blockPackets(b uint64) int {
+	k := uint64(pt.fec.k)
+	if pt.packets <= b*k {
+		return 0
+	}
+	if pt.packets-b*k < k {
+		return int(pt.packets - b*k)
+	}
+	return pt.fec.k
+}
+
+func (pt *PendingFileTransfer) blockComplete(b uint64) bool {
+	first := b * uint64(pt.fec.k)
+	for i := 0; i < pt.blockPackets(b); i++ {
+		if !pt.hasPacket(first + uint64(i)) {
+			return false
+		}
+	}
+	return true
+}
+
+// recoverFecBlock reconstructs the lost data packets of block b if enough
+// repair packets have been received
+func (s *fileSession) recoverFecBlock(pt *PendingFileTransfer, b uint64) error {
+	repairs := pt.repairs[b]
+	n := pt.blockPackets(b)
+	first := b * uint64(pt.fec.k)
+	missing := 0
+	for i := 0; i < n; i++ {
+		if !pt.hasPacket(first + uint64(i)) {
+			missing++
+		}
+	}
+	if missing == 0 {
+		delete(pt.repairs, b)
+		return nil
+	}
+	available := 0
+	for j := range repairs {
+		if repairs[j] != nil {
+			available++
+		}
+	}
+	if available < missing {
+		return nil
+	}
+
+	data := make([][]byte, pt.fec.k)
+	for i := range data {
+		if i < n && !pt.hasPacket(first+uint64(i)) {
+			continue
+		}
+		data[i] = make([]byte, pt.chunkSize)
+		if i < n {
+			_, err := pt.file.ReadAt(data[i][:pt.packetLen(first+uint64(i))], int64((first+uint64(i))*uint64(pt.chunkSize)))
+			if err != nil {
+				return s.abortFileTransfer(pt, errors.New("Failed to read tmp file: "+err.Error()))
+			}
+		}
+	}
+	err := pt.fec.reconstruct(data, repairs)
+	if err != nil {
+		return s.abortFileTransfer(pt, errors.New("Failed to recover FEC block "+strconv.FormatUint(b, 10)+": "+err.Error()))
+	}
+	delete(pt.repairs, b)
+	for i := 0; i < n; i++ {
+		p := first + uint64(i)
+		if !pt.hasPacket(p) {
+			err = s.storePacket(pt, p, data[i][:pt.packetLen(p)])
+			if err != nil {
+				return err
+			}
+			pt.recovered++
+			if p < pt.declared {
+				// declared lost before the repairs arrived
+				pt.dropped--
+			}
+		}
+	}
 	return nil
 }
 
@@ -96,98 +528,258 @@ func (r *Receiver) onFileTransferData(buff []byte, read int) error {
  * file transfer start packet
  *
  * type - uint8 - 0x02
- * filetype - uint8 - (regular file)
+ * filetype - uint8 - file type (regular file) | content encoding
  * manifestSessionId - uint32 - manifest session id
  * fileIndex - uint32 - file index in the manifest
- * size - uint64 - size of file in bytes
- * mtime - int64 - unix millis
- * sign - byte[64] - hmac512 of this header
+ * size - uint64 - size of file in bytes, after content encoding
+ * mtime - int64 - unix seconds
+ * fecData - uint8 - data packets per FEC block
+ * fecParity - uint8 - repair packets per FEC block, 0 if FEC is disabled
+ * chunkSize - uint32 - payload size of every data packet but the last
+ * macSize - uint8 - size of the MAC in data and repair packets, 0 if disabled
+ * sign - byte[] - hmac512 or ed25519 signature of this header
  */
-func (r *Receiver) onFileTransferStart(buff []byte, read int) error {
-	if read < 1+1+4+4+8+8+64 {
-		return errors.New("Received truncated file transfer start packet")
+type fileStart struct {
+	encoding   byte
+	manifestId int
+	fileIndex  int
+	size       uint64
+	fec        *fecCodec
+	chunkSize  int
+	macSize    int
+}
+
+const FILE_START_SIZE = 1 + 1 + 4 + 4 + 8 + 8 + 1 + 1 + 4 + 1
+
+// parseFileStart verifies and decodes a file transfer start packet
+func parseFileStart(buff []byte, v verifier) (*fileStart, error) {
+	if len(buff) < FILE_START_SIZE+v.size() {
+		return nil, errors.New("Received truncated file transfer start packet")
+	}
+	err := v.verify(buff[:FILE_START_SIZE], buff[FILE_START_SIZE:FILE_START_SIZE+v.size()])
+	if err != nil {
+		return nil, errors.New("Invalid signature in file start packet: " + err.Error())
+	}
+	if buff[1]&FILE_TYPE_MASK != FILE_TYPE_REGULAR {
+		return nil, errors.New("Ignoring file transfer start with unknown file type " + strconv.Itoa(int(buff[1]&FILE_TYPE_MASK)))
+	}
+	st := fileStart{encoding: buff[1] & ENCODING_MASK}
+	if st.encoding != ENCODING_NONE && st.encoding != ENCODING_GZIP {
+		return nil, errors.New("Ignoring file transfer start with unsupported content encoding " + encodingName(st.encoding))
+	}
+	st.manifestId = int(binary.BigEndian.Uint32(buff[2:]))
+	st.fileIndex = int(binary.BigEndian.Uint32(buff[6:]))
+	st.size = binary.BigEndian.Uint64(buff[10:])
+	if buff[27] > 0 {
+		st.fec, err = newFecCodec(int(buff[26]), int(buff[27]))
+		if err != nil {
+			return nil, errors.New("Invalid FEC parameters in file start packet: " + err.Error())
+		}
+	}
+	st.chunkSize = int(binary.BigEndian.Uint32(buff[28:]))
+	if st.chunkSize < 1 {
+		return nil, errors.New("Invalid chunk size in file start packet")
 	}
-	if r.pendingFileTransfer != nil {
-		//TODO: check if same file
-		fmt.Fprintf(os.Stderr, "Received new file transfer with previous still pending\n")
-		r.pendingFileTransfer.file.Close()
-		r.pendingFileTransfer = nil
+	st.macSize = int(buff[32])
+	if err = checkPacketMacSize(st.macSize); err != nil {
+		return nil, errors.New("Invalid MAC size in file start packet: " + err.Error())
 	}
+	return &st, nil
+}
 
-	if r.manifest == nil {
-		return errors.New("Received file transfer start packet without pending manifest")
+func (s *fileSession) onFileTransferStart(buff []byte, read int) error {
+	start, err := parseFileStart(buff[:read], s.verifier)
+	if err != nil {
+		return err
+	}
+	s.lastSeen = time.Now()
+	if s.pendingFileTransfer != nil {
+		s.log.Warn("Received new file transfer with previous still pending", s.fileFields(s.pendingFileTransfer)...)
+		s.suspendFileTransfer(s.pendingFileTransfer)
+		s.pendingFileTransfer = nil
 	}
 
-	if buff[1] != 0 {
-		return errors.New("Ignoring file transfer start with unknown file type " + strconv.Itoa(int(buff[2])))
+	if s.manifest == nil {
+		return errors.New("Received file transfer start packet without pending manifest")
 	}
 
-	manifestId := int(binary.BigEndian.Uint32(buff[2:]))
-	if manifestId != r.manifestId {
-		return errors.New("Ignoring file transfer start for another manifest " + strconv.Itoa(manifestId) + " " + strconv.Itoa(manifestId))
+	manifestId := start.manifestId
+	if manifestId != s.manifestId {
+		return fieldErr("Ignoring file transfer start for another manifest", "other", hexId(uint32(manifestId)))
 	}
 
-	fileIndex := int(binary.BigEndian.Uint32(buff[6:]))
-	if fileIndex < 0 || fileIndex >= len(r.manifest.files) {
-		return errors.New("Ignoring file transfer start for invalid file index")
+	fileIndex := start.fileIndex
+	if fileIndex < 0 || fileIndex >= len(s.manifest.files) {
+		return fieldErr("Ignoring file transfer start for invalid file index", "file", fileIndex)
 	}
 
-	mf := r.manifest.files[fileIndex]
+	mf := s.manifest.files[fileIndex]
 
 	//sanitize path
-	fp := path.Clean(r.dir + mf.path)
+	fp := path.Clean(s.dir + mf.path)
 	if fp == "." {
-		return errors.New("Invalid file path name")
+		return fieldErr("Invalid file path name", "file", fileIndex, "path", mf.path)
 	}
 
-	size := binary.BigEndian.Uint64(buff[10:])
+	// encoded content is never larger than the original
+	size := start.size
+	if size > uint64(mf.size) || (start.encoding == ENCODING_NONE && size != uint64(mf.size)) {
+		return fieldErr("Invalid size in file start packet", "file", fileIndex, "path", mf.path)
+	}
+	encoding := start.encoding
+	fec := start.fec
+	chunkSize := start.chunkSize
+	if chunkSize > maxPayload(s.conf)-DATA_HEADER_SIZE {
+		return fieldErr("Invalid chunk size in file start packet", "file", fileIndex, "path", mf.path)
+	}
+	var pm *packetMac
+	if start.macSize > 0 {
+		err := checkMacSecret(s.conf, "data MACs")
+		if err != nil {
+			return withFields(err, "file", fileIndex, "path", mf.path)
+		}
+		pm = newPacketMac(s.conf.HMACSecret, start.macSize)
+	}
 
-	h512 := sha512.New()
-	io.WriteString(h512, r.conf.HMACSecret)
-	mac := hmac.New(sha512.New, h512.Sum(nil))
-	mac.Write(buff[:26])
-	if !bytes.Equal(mac.Sum(nil), buff[26:26+64]) {
-		return errors.New("Invalid signature in file start packet for " + fp)
+	key := fileTransferKey{manifestId, fileIndex}
+	if s.completedTransfers[key] || s.movingTransfers[key] {
+		// already received in an earlier round
+		return nil
+	}
+	pt, exists := s.partialTransfers[key]
+	if exists {
+		delete(s.partialTransfers, key)
+		sameFec := pt.fec == fec || (pt.fec != nil && fec != nil && *pt.fec == *fec)
+		sameMac := (pt.mac == nil && pm == nil) || (pt.mac != nil && pm != nil && pt.mac.size == pm.size)
+		if pt.size == size && pt.encoding == encoding && pt.chunkSize == chunkSize && sameFec && sameMac {
+			pt.file, err = os.OpenFile(pt.tmpFilename, os.O_RDWR, s.conf.Receiver.FilePermission)
+			if err == nil {
+				s.log.Info("Resuming file", s.fileFields(pt, "missing", pt.size-pt.receivedBytes())...)
+				pt.next = 0
+				pt.declared = 0
+				pt.resumed = true
+				s.pendingFileTransfer = pt
+				return nil
+			}
+		}
+		os.Remove(pt.tmpFilename)
 	}
 
-	tmpFile := path.Join(r.tmpDir, "godiodetmp."+strconv.FormatUint(uint64(manifestId), 16)+"."+strconv.Itoa(fileIndex))
-	file, err := os.OpenFile(tmpFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, r.conf.Receiver.FilePermission)
+	tmpFile := path.Join(s.tmpDir, "godiodetmp."+strconv.FormatUint(uint64(manifestId), 16)+"."+strconv.Itoa(fileIndex))
+	file, err := os.OpenFile(tmpFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, s.conf.Receiver.FilePermission)
 	if err != nil {
-		return errors.New("Failed to create file " + fp + ": " + err.Error())
+		return fieldErr("Failed to create tmp file: "+err.Error(), "file", fileIndex, "path", mf.path)
 	}
-	r.pendingFileTransfer = &PendingFileTransfer{
+	packets := (size + uint64(chunkSize) - 1) / uint64(chunkSize)
+	s.pendingFileTransfer = &PendingFileTransfer{
 		size:          size,
 		hash:          sha256.New(),
 		file:          file,
 		transferStart: time.Now(),
 		filename:      fp,
+		path:          mf.path,
 		fileIndex:     fileIndex,
 		modts:         mf.modts,
+		contentSize:   mf.size,
+		encoding:      encoding,
+		tmpFilename:   tmpFile,
+		chunkSize:     chunkSize,
+		packets:       packets,
+		received:      make([]uint64, (packets+63)/64),
+		fec:           fec,
+		repairs:       map[uint64][][]byte{},
+		mac:           pm,
+		window:        make([]reorderSlot, s.conf.Receiver.ReorderWindow),
 	}
+	s.log.Info("Receiving file", s.fileFields(s.pendingFileTransfer, "size", mf.size, "encoding", encodingName(encoding))...)
 	return nil
 }
 
-func (r *Receiver) moveTmpFile(pft *PendingFileTransfer, tmpFile string) {
-	timeTaken := float64(time.Duration.Seconds(time.Since(pft.transferStart)))
+// movedFile is the outcome of moving a received file into place
+type movedFile struct {
+	s   *fileSession
+	pft *PendingFileTransfer
+	err error
+}
+
+// committer moves verified files into place off the receive loop, handing
+// the outcome back to the receive loop
+type committer struct {
+	lock  sync.Mutex
+	moved []movedFile
+	wg    sync.WaitGroup
+	// interrupts the receive loop waiting for packets
+	wake func()
+}
+
+func (c *committer) commit(s *fileSession, pft *PendingFileTransfer, tmpFile string) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		err := s.moveTmpFile(pft, tmpFile)
+		c.lock.Lock()
+		c.moved = append(c.moved, movedFile{s, pft, err})
+		c.lock.Unlock()
+		c.wake()
+	}()
+}
+
+// collect completes the moved files, with wait once all moves have finished
+func (c *committer) collect(wait bool) {
+	if wait {
+		c.wg.Wait()
+	}
+	c.lock.Lock()
+	moved := c.moved
+	c.moved = nil
+	c.lock.Unlock()
+	for _, m := range moved {
+		m.s.onFileMoved(m.pft, m.err)
+	}
+}
+
+func (s *fileSession) moveTmpFile(pft *PendingFileTransfer, tmpFile string) error {
 	err := os.Rename(tmpFile, pft.filename)
 	if err != nil {
 		//TODO: fallback to copy+rm (file may be located on another fs)
-		fmt.Fprintf(os.Stderr, "Failed to move tmp file "+pft.filename+" "+err.Error()+"\n")
-		return
+		return errors.New("Failed to move tmp file: " + err.Error())
 	}
 	err = os.Chtimes(pft.filename, time.Unix(int64(pft.modts), 0), time.Unix(int64(pft.modts), 0))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to set mtime on "+pft.filename+"\n")
+		s.log.Warn("Failed to set mtime", "path", pft.filename, "err", err)
 	}
-	if r.conf.Verbose {
-		var speed int = 0
-		if timeTaken > 0 {
-			speed = int(math.Round(float64((8*pft.size)/1000) / timeTaken))
+	return nil
+}
+
+// onFileMoved completes a file once moved into place, a failed file is
+// received again by later rounds
+func (s *fileSession) onFileMoved(pft *PendingFileTransfer, err error) {
+	key := fileTransferKey{s.manifestId, pft.fileIndex}
+	delete(s.movingTransfers, key)
+	if err != nil {
+		s.fileFailed(pft, err)
+		return
+	}
+	s.completedTransfers[key] = true
+	s.metrics.filesCommitted.add(1)
+	s.metrics.committedBytes.add(uint64(pft.contentSize))
+	timeTaken := float64(time.Duration.Seconds(time.Since(pft.transferStart)))
+	var speed int = 0
+	if timeTaken > 0 {
+		speed = int(math.Round(float64((8*pft.size)/1000) / timeTaken))
+	}
+	checksum := hex.EncodeToString(pft.hash.Sum(nil))
+	s.log.Info("Received file", s.fileFields(pft, append([]interface{}{"checksum", checksum, "size", pft.contentSize, "encoding", encodingName(pft.encoding), "kbps", speed}, pft.stats()...)...)...)
+	s.status.update(pft.fileIndex, FILE_STATUS_RECEIVED, checksum, "")
+	if s.journal != nil {
+		err = s.journal.append(&journalEntry{time.Now(), hexId(uint32(s.manifestId)), s.manifest.senderId, pft.fileIndex, pft.path, pft.contentSize, checksum})
+		if err != nil {
+			s.log.Error("Failed to write journal", s.fileFields(pft, "err", err)...)
 		}
-		h := pft.hash.Sum(nil)
-		fmt.Println("Successfully received " + pft.filename + ", checksum=" + hex.EncodeToString(h) + " size=" + strconv.FormatInt(int64(pft.size), 10) + " " + strconv.Itoa(speed) + "kbit/s")
 	}
-	return
+	if s.onReceived != nil {
+		s.onReceived(FileEvent{Sender: s.manifest.senderId, Path: pft.path, Size: pft.contentSize})
+	}
 }
 
 /*
@@ -197,132 +789,218 @@ func (r *Receiver) moveTmpFile(pft *PendingFileTransfer, tmpFile string) {
  * manifestSessionId - uint32 - manifest session id
  * fileIndex - uint32 - file index in the manifest
  * hash - byte[32] - sha256 of file content
- * sign - byte[64] - hmac512 of this packet
+ * sign - byte[] - hmac512 or ed25519 signature of this packet
  */
-func (r *Receiver) onFileTransferComplete(buff []byte, read int) error {
-	if read < 1+4+4+32+64 {
-		return errors.New("Received truncated file transfer complete packet")
+type fileComplete struct {
+	manifestId int
+	fileIndex  int
+	hash       []byte
+}
+
+const FILE_COMPLETE_SIZE = 1 + 4 + 4 + 32
+
+// parseFileComplete verifies and decodes a file transfer complete packet
+func parseFileComplete(buff []byte, v verifier) (*fileComplete, error) {
+	if len(buff) < FILE_COMPLETE_SIZE+v.size() {
+		return nil, errors.New("Received truncated file transfer complete packet")
+	}
+	err := v.verify(buff[:FILE_COMPLETE_SIZE], buff[FILE_COMPLETE_SIZE:FILE_COMPLETE_SIZE+v.size()])
+	if err != nil {
+		return nil, errors.New("Invalid signature in file complete packet: " + err.Error())
+	}
+	return &fileComplete{
+		manifestId: int(binary.BigEndian.Uint32(buff[1:])),
+		fileIndex:  int(binary.BigEndian.Uint32(buff[5:])),
+		hash:       buff[9:FILE_COMPLETE_SIZE],
+	}, nil
+}
+
+func (s *fileSession) onFileTransferComplete(buff []byte, read int) error {
+	complete, err := parseFileComplete(buff[:read], s.verifier)
+	if err != nil {
+		return err
 	}
+	s.lastSeen = time.Now()
+	manifestId := complete.manifestId
+	fileIndex := complete.fileIndex
 
-	pft := r.pendingFileTransfer
+	pft := s.pendingFileTransfer
 	if pft == nil {
+		key := fileTransferKey{manifestId, fileIndex}
+		if s.completedTransfers[key] || s.movingTransfers[key] {
+			// already received in an earlier round
+			return nil
+		}
 		return errors.New("Received file transfer complete packet without pending transfer")
 	}
-
-	offset := 1
-	manifestId := int(binary.BigEndian.Uint32(buff[offset:]))
-	offset += 4
-	if manifestId != r.manifestId {
-		return errors.New("Ignoring file transfer complete for another manifest " + strconv.Itoa(manifestId) + " " + strconv.Itoa(manifestId))
+	if manifestId != s.manifestId {
+		return fieldErr("Ignoring file transfer complete for another manifest", "other", hexId(uint32(manifestId)))
 	}
-
-	fileIndex := int(binary.BigEndian.Uint32(buff[offset:]))
-	offset += 4
 	if fileIndex != pft.fileIndex {
-		return errors.New("Ignoring file transfer complete for other file than the current pending")
+		return fieldErr("Ignoring file transfer complete for other file than the current pending", "file", fileIndex, "pending", pft.fileIndex)
 	}
+	h := complete.hash
 
-	h := buff[offset : offset+32]
-	offset += 32
-
-	h512 := sha512.New()
-	io.WriteString(h512, r.conf.HMACSecret)
-	mac := hmac.New(sha512.New, h512.Sum(nil))
-	mac.Write(buff[:offset])
-	if !bytes.Equal(mac.Sum(nil), buff[offset:offset+64]) {
-		return errors.New("Invalid signature in file complete packet for file " + pft.filename)
+	s.pendingFileTransfer = nil
+	if pft.err != nil {
+		s.fileFailed(pft, *pft.err)
+		return nil
+	}
+	if pft.offset != pft.size {
+		if !pft.resumed {
+			// the round is over, anything still missing was lost
+			pft.declareLost(pft.packets)
+		}
+		s.suspendFileTransfer(pft)
+		missing := pft.missing()
+		lost := uint64(0)
+		gaps := ""
+		for i := range missing {
+			lost += missing[i][1] - missing[i][0]
+			if i < 10 {
+				gaps += " " + strconv.FormatUint(missing[i][0], 10) + "-" + strconv.FormatUint(missing[i][1], 10)
+			}
+		}
+		if len(missing) > 10 {
+			gaps += " ..."
+		}
+		s.fileFailed(pft, errors.New("Lost "+strconv.FormatUint(lost, 10)+" bytes in "+strconv.Itoa(len(missing))+" gaps, keeping for retransmission:"+gaps), pft.stats()...)
+		return nil
 	}
-
 	pft.file.Close()
-	r.pendingFileTransfer = nil
+	tmpFile := pft.tmpFilename
+	if pft.encoding != ENCODING_NONE {
+		// the incremental hash covers the encoded stream, hash the decoded content instead
+		tmpFile = pft.tmpFilename + ".dec"
+		pft.hash = sha256.New()
+		err = decodeFile(pft.tmpFilename, tmpFile, pft.encoding, pft.contentSize, pft.hash, s.conf.Receiver.FilePermission)
+		os.Remove(pft.tmpFilename)
+		if err != nil {
+			s.fileFailed(pft, errors.New("Failed to decode: "+err.Error()))
+			return nil
+		}
+	}
 	if !bytes.Equal(h, pft.hash.Sum(nil)) {
-		os.Remove(pft.filename)
-		return errors.New("Data checksum error for received file " + pft.filename)
+		os.Remove(tmpFile)
+		s.metrics.checksumFailures.add(1)
+		s.fileFailed(pft, errors.New("Data checksum error"))
+		return nil
 	}
-	tmpFile := path.Join(r.tmpDir, "godiodetmp."+strconv.FormatUint(uint64(manifestId), 16)+"."+strconv.Itoa(fileIndex))
-	go r.moveTmpFile(pft, tmpFile)
+	s.movingTransfers[fileTransferKey{manifestId, fileIndex}] = true
+	s.commits.commit(s, pft, tmpFile)
 	return nil
 }
 
-func (r *Receiver) createFolders() error {
-	if r.manifest == nil {
+func (s *fileSession) createFolders() error {
+	if s.manifest == nil {
 		return errors.New("No manifest")
 	}
-	for d := range r.manifest.dirs {
-		p := r.dir + path.Clean(r.manifest.dirs[d].path)
-		err := os.MkdirAll(p, r.conf.Receiver.FolderPermission)
+	for d := range s.manifest.dirs {
+		p := s.dir + path.Clean(s.manifest.dirs[d].path)
+		err := os.MkdirAll(p, s.conf.Receiver.FolderPermission)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error creating dir "+p+"\n")
+			s.log.Error("Failed to create dir", "path", p, "err", err)
 		} else {
-			err = os.Chtimes(p, time.Unix(int64(r.manifest.dirs[d].modts), 0), time.Unix(int64(r.manifest.dirs[d].modts), 0))
+			err = os.Chtimes(p, time.Unix(int64(s.manifest.dirs[d].modts), 0), time.Unix(int64(s.manifest.dirs[d].modts), 0))
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to set mtime on "+p+"\n")
+				s.log.Warn("Failed to set mtime", "path", p, "err", err)
 			}
 		}
 	}
 	return nil
 }
 
-func (r *Receiver) handleManifestReceived() error {
-	if r.conf.Verbose {
-		fmt.Println("Received valid manifest with " + strconv.Itoa(len(r.manifest.dirs)) + " dirs, " + strconv.Itoa(len(r.manifest.files)) + " files")
+func (s *fileSession) handleManifestReceived() error {
+	fields := []interface{}{"manifest", hexId(uint32(s.manifestId)), "sender", s.manifest.senderId, "dirs", len(s.manifest.dirs), "files", len(s.manifest.files), "features", featureNames(s.manifest.features)}
+	if s.manifest.features&FEATURE_RESEND != 0 {
+		fields = append(fields, "origin", hexId(s.manifest.originId))
+	}
+	s.log.Info("Received manifest", fields...)
+	if s.conf.Receiver.Delete && s.sharedDir {
+		s.log.Warn("Not deleting files of a receive dir shared by several senders, enable sender dirs to delete", "sender", s.manifest.senderId)
 	}
-	if r.conf.Receiver.Delete {
+	// a resend only lists the missing files of the original session
+	if s.conf.Receiver.Delete && !s.sharedDir && s.manifest.features&FEATURE_RESEND == 0 {
+		// files of the receiver itself kept in the receive dir
+		keep := map[string]bool{}
+		for _, p := range []string{s.tmpDir, s.conf.Receiver.ReportDir, s.conf.Receiver.Journal, s.conf.StateFile, s.conf.Receiver.HealthFile} {
+			if p == "" {
+				continue
+			}
+			abs, err := filepath.Abs(p)
+			if err == nil {
+				keep[abs] = true
+			}
+		}
+		// keyed by path relative to the receive dir, like the manifest
 		dm := map[string]bool{}
 		fm := map[string]FileRecord{}
-		filepath.WalkDir(r.dir, func(p string, d fs.DirEntry, err error) error {
+		filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
 			if err != nil {
 				return nil
 			}
-			if p == r.dir {
+			if p == s.dir {
+				return nil
+			}
+			rel := strings.TrimPrefix(p, s.dir)
+			if abs, err := filepath.Abs(p); err != nil || keep[abs] {
+				// keep the dirs leading to it too
+				for parent := path.Dir(rel); parent != "." && parent != "/"; parent = path.Dir(parent) {
+					delete(dm, parent)
+				}
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
 				return nil
 			}
 			if d.IsDir() {
-				dm[p] = true
+				dm[rel] = true
 			} else {
 				finfo, err := os.Stat(p)
 				if err != nil {
 					return nil
 				}
-				fm[p] = FileRecord{DirRecord{p, uint32(finfo.ModTime().Unix())}, finfo.Size()}
+				fm[rel] = FileRecord{DirRecord{rel, uint32(finfo.ModTime().Unix())}, finfo.Size()}
 			}
 			return nil
 		})
-		for i := range r.manifest.files {
-			f, exists := fm[r.manifest.files[i].path]
-			if exists && f.size == r.manifest.files[i].size && f.modts == r.manifest.files[i].modts {
+		for i := range s.manifest.files {
+			p := path.Clean(s.manifest.files[i].path)
+			f, exists := fm[p]
+			if exists && f.size == s.manifest.files[i].size && f.modts == s.manifest.files[i].modts {
 				//keep this file
-				delete(fm, r.manifest.files[i].path)
+				delete(fm, p)
 			}
 		}
 		for f, _ := range fm {
-			err := os.Remove(f)
+			err := os.Remove(s.dir + f)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to delete file "+f+"\n")
-			} else if r.conf.Verbose {
-				fmt.Println("Removed file " + f)
+				s.log.Error("Failed to delete file", "path", s.dir+f, "err", err)
+			} else {
+				s.log.Info("Removed file", "path", s.dir+f)
 			}
 		}
 
-		for i := range r.manifest.dirs {
-			_, exists := dm[r.manifest.dirs[i].path]
-			if exists {
-				//keep this dir
-				delete(dm, r.manifest.dirs[i].path)
-			}
+		for i := range s.manifest.dirs {
+			//keep this dir
+			delete(dm, path.Clean(s.manifest.dirs[i].path))
 		}
+		dirs := make([]string, 0, len(dm))
 		for d, _ := range dm {
-			if d != r.tmpDir {
-				err := os.Remove(d)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "Failed to delete dir "+d+"\n")
-				} else if r.conf.Verbose {
-					fmt.Println("Removed dir " + d)
-				}
+			dirs = append(dirs, d)
+		}
+		// remove nested dirs before their parents
+		sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+		for _, d := range dirs {
+			err := os.Remove(s.dir + d)
+			if err != nil {
+				s.log.Error("Failed to delete dir", "path", s.dir+d, "err", err)
+			} else {
+				s.log.Info("Removed dir", "path", s.dir+d)
 			}
 		}
 	}
-	err := r.createFolders()
+	err := s.createFolders()
 	return err
 }
 
@@ -336,110 +1014,241 @@ func (r *Receiver) handleManifestReceived() error {
  * payload | manifest chunk
  *
  */
-func (r *Receiver) onManifestPacket(buff []byte, read int) error {
-	if read < 10 {
+// onManifestData decodes a completely received manifest and makes it the
+// current one
+func (r *fileReceiver) onManifestData(manifestId int, data []byte) error {
+	raw := data
+	var sc *sessionCipher
+	if r.conf.EncryptionKey != "" {
+		var err error
+		sc, data, err = openManifest(r.conf.EncryptionKey, uint32(manifestId), data)
+		if err != nil {
+			r.metrics.authFailed(AUTH_DECRYPTION)
+			return errors.New("Failed to decrypt manifest: " + err.Error())
+		}
+	}
+	manifest, err := deserializeManifest(data, r.verifier)
+	if err != nil {
+		return err
+	}
+	if prev := r.sessions[manifestId]; prev != nil {
+		// data packets only carry the manifest id, the session keeps it
+		if !prev.collided {
+			prev.collided = true
+			r.metrics.manifestCollisions.add(1)
+			r.log.Warn("Ignoring manifest with the id of another session", "manifest", hexId(uint32(manifestId)), "sender", manifest.senderId, "session sender", prev.manifest.senderId)
+		}
 		return nil
 	}
+	if manifest.features&^SUPPORTED_FEATURES != 0 {
+		return fieldErr("Manifest requires unsupported features", "sender", manifest.senderId, "features", featureNames(manifest.features&^SUPPORTED_FEATURES))
+	}
+	dir := r.dir
+	if r.conf.Receiver.SenderDirs {
+		err = checkSenderId(manifest.senderId)
+		if err != nil {
+			return err
+		}
+		dir = r.dir + manifest.senderId + "/"
+	}
+	err = r.replay.accept(manifest)
+	if err != nil {
+		return err
+	}
+	if dir != r.dir {
+		err = os.MkdirAll(dir, r.conf.Receiver.FolderPermission)
+		if err != nil {
+			return fieldErr("Failed to create sender dir: "+err.Error(), "sender", manifest.senderId)
+		}
+	}
+	for _, prev := range r.sessions {
+		if prev.manifest.senderId == manifest.senderId {
+			// superseded by the new session
+			prev.writeReport()
+		}
+	}
+	s := &fileSession{
+		conf:               r.conf,
+		log:                r.log,
+		metrics:            r.metrics,
+		verifier:           r.verifier,
+		dir:                dir,
+		sharedDir:          !r.conf.Receiver.SenderDirs && r.replay.otherSenders(manifest.senderId),
+		tmpDir:             r.tmpDir,
+		manifest:           manifest,
+		manifestId:         manifestId,
+		partialTransfers:   map[fileTransferKey]*PendingFileTransfer{},
+		completedTransfers: map[fileTransferKey]bool{},
+		movingTransfers:    map[fileTransferKey]bool{},
+		commits:            r.commits,
+		cipher:             sc,
+		rawManifest:        raw,
+		lastSeen:           time.Now(),
+		status:             newTransferStatus(manifest),
+		journal:            r.journal,
+		onReceived:         r.onReceived,
+		onFailed:           r.onFailed,
+	}
+	r.sessions[manifestId] = s
+	r.metrics.manifestsReceived.add(1)
+	return s.handleManifestReceived()
+}
+
+// repeatsManifest reports whether the payload of a manifest part 0 is the
+// start of the manifest of the session
+func (s *fileSession) repeatsManifest(payload []byte) bool {
+	if len(payload) < 4 || int(binary.BigEndian.Uint32(payload)) != len(s.rawManifest) {
+		return false
+	}
+	return bytes.HasPrefix(s.rawManifest, payload[4:])
+}
+
+// checkSenderId rejects sender ids not usable as a dir name
+func checkSenderId(id string) error {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, "/\\\x00") {
+		return fieldErr("Invalid sender id for a sender dir", "sender", id)
+	}
+	return nil
+}
+
+func (r *fileReceiver) onManifestPacket(buff []byte, read int) error {
+	if read < 7 {
+		return errors.New("Received truncated manifest packet")
+	}
 	manifestId := int(binary.BigEndian.Uint32(buff[1:]))
+	err := r.onManifestPart(manifestId, buff, read)
+	if err != nil {
+		return withFields(err, "manifest", hexId(uint32(manifestId)))
+	}
+	return nil
+}
 
-	if r.lastManifestId == manifestId {
+// onManifestPart collects a manifest packet of at least 7 bytes, decoding
+// the manifest once complete
+func (r *fileReceiver) onManifestPart(manifestId int, buff []byte, read int) error {
+	part := int(binary.BigEndian.Uint16(buff[5:]))
+	pmt := r.manifests[manifestId]
+	if s := r.sessions[manifestId]; s != nil && (part != 0 && pmt == nil || part == 0 && s.repeatsManifest(buff[7:read])) {
 		//We've already got this manifest.
 		return nil
 	}
-	part := int(binary.BigEndian.Uint16(buff[5:]))
-	pmt := r.pendingManifestTransfer
-	if pmt != nil {
-		if manifestId != r.manifestId {
-			fmt.Fprintf(os.Stderr, "Replacing pending manifest before completed\n")
-			r.pendingManifestTransfer = nil
-			pmt = nil
-		} else {
-			if part != pmt.index {
-				r.pendingManifestTransfer = nil
-				return errors.New("Received out of order manifest packet")
-			}
-			read = copy(pmt.buff[pmt.offset:], buff[7:read])
-			pmt.offset += read
-			if pmt.offset == len(pmt.buff) {
-				manifest, err := deserializeManifest(pmt.buff, r.conf.HMACSecret)
-				if err != nil {
-					return err
-				}
-				if r.lastManifestId != manifestId {
-					r.manifest = manifest
-					err = r.handleManifestReceived()
-					if err != nil {
-						return err
-					}
-
-					r.lastManifestId = manifestId
-				}
-				return nil
-			}
-			pmt.index++
-		}
-	}
 	if pmt == nil {
 		if part != 0 {
 			return errors.New("Unexpected manifest part received")
 		}
+		if read < 11 {
+			return errors.New("Received truncated manifest packet")
+		}
 		size := int(binary.BigEndian.Uint32(buff[7:]))
 		if size > 5*1024*1024 || size < 1 {
 			return errors.New("Too large manifest")
 		}
-		r.manifestId = manifestId
 		manifestData := make([]byte, size)
-		read = copy(manifestData, buff[11:])
+		read = copy(manifestData, buff[11:read])
 		if read == size {
-			manifest, err := deserializeManifest(manifestData, r.conf.HMACSecret)
-			if err != nil {
-				return err
-			}
-			if r.lastManifestId != manifestId {
-				r.manifest = manifest
-				err = r.handleManifestReceived()
-				if err != nil {
-					return err
+			return r.onManifestData(manifestId, manifestData)
+		}
+		if len(r.manifests) >= MAX_PENDING_MANIFESTS {
+			oldest := -1
+			for id, m := range r.manifests {
+				if oldest == -1 || m.lastSeen.Before(r.manifests[oldest].lastSeen) {
+					oldest = id
 				}
-
-				r.lastManifestId = manifestId
 			}
-			return nil
+			r.log.Warn("Too many manifests received concurrently, dropping the oldest", "manifest", hexId(uint32(oldest)))
+			delete(r.manifests, oldest)
 		}
-		r.pendingManifestTransfer = &PendingManifestTransfer{manifestData, read, 1}
+		r.manifests[manifestId] = &PendingManifestTransfer{manifestData, read, 1, time.Now()}
 		return nil
 	}
+	if part != pmt.index {
+		delete(r.manifests, manifestId)
+		r.metrics.outOfOrderAborts.add(1)
+		return errors.New("Received out of order manifest packet")
+	}
+	read = copy(pmt.buff[pmt.offset:], buff[7:read])
+	pmt.offset += read
+	pmt.lastSeen = time.Now()
+	if pmt.offset == len(pmt.buff) {
+		delete(r.manifests, manifestId)
+		return r.onManifestData(manifestId, pmt.buff)
+	}
+	pmt.index++
 	return nil
 }
 
+// session returns the session of a file transfer packet, nil if it is unknown
+func (r *fileReceiver) session(buff []byte, read int) *fileSession {
+	hdrLen := 5
+	if buff[0] == 0x02 {
+		hdrLen = 6
+	}
+	if read < hdrLen {
+		return nil
+	}
+	return r.sessions[int(binary.BigEndian.Uint32(buff[hdrLen-4:]))]
+}
+
+// openPacket decrypts a sealed file transfer packet of the session
+func (r *fileReceiver) openPacket(s *fileSession, buff []byte, read int) ([]byte, int, error) {
+	hdrLen := 5
+	if buff[0] == 0x02 {
+		hdrLen = 6
+	}
+	if s.cipher == nil {
+		return nil, 0, nil
+	}
+	plain, err := s.cipher.open(r.plain, buff[:read], hdrLen)
+	if err != nil {
+		r.metrics.authFailed(AUTH_DECRYPTION)
+		return nil, 0, errors.New("Packet failing decryption: " + err.Error())
+	}
+	r.plain = plain
+	return plain, len(plain), nil
+}
+
+// expireSessions drops sessions and manifests without packets for the
+// session timeout
+func (r *fileReceiver) expireSessions() {
+	if time.Since(r.lastSweep) < time.Second {
+		return
+	}
+	r.lastSweep = time.Now()
+	for id, s := range r.sessions {
+		if time.Since(s.lastSeen) > time.Duration(r.conf.Receiver.ReportTimeout)*time.Second {
+			s.writeReport()
+		}
+		if time.Since(s.lastSeen) > SESSION_TIMEOUT {
+			r.log.Info("Session expired", "manifest", hexId(uint32(id)), "sender", s.manifest.senderId)
+			s.discardPartialTransfers()
+			delete(r.sessions, id)
+		}
+	}
+	for id, m := range r.manifests {
+		if time.Since(m.lastSeen) > SESSION_TIMEOUT {
+			delete(r.manifests, id)
+		}
+	}
+}
+
+// writeReports writes the reports of all sessions changed since they were
+// last written
+func (r *fileReceiver) writeReports() {
+	for _, s := range r.sessions {
+		s.writeReport()
+	}
+}
+
 /**
  * Protocol format
  *
- * | type | payload... |
- * type - uint8
- *   0x00 - heartbeat
- *   0x01 - manifest
- *   0x02 - file transfer start
- *   0x80-0xFF - file transfer data
- *
- * manifest
- * | type | id | part | [size] | payload
- * type - uint8 - 0x01
- * id - uint16 - manifest session id
- * part - uint16 - manifest session part index
- * size - uint32 - total manifest size (including signature), only sent in part 0
- * payload | <utf8-json> + \n + hmac signature asciihex
- *
- * file transfer start
- * | filename | type | size | mtime | sign |
- * type - uint8 - 0x02 (regular file)
- * size - uint64 - size of file in bytes
- * mtime - uint64 - unix millis
- * sign - byte[64] - hmac512 of this header
+ * See protocol.go for the header of every packet and sender.go for the
+ * packet types and formats.
  */
 
-func receive(conf *Config, dir string) error {
-
+// Receive writes the files of all manifest sessions received to dir
+func (r *Receiver) Receive(ctx context.Context, dir string) error {
+	conf := r.conf
 	dir = path.Clean(dir) + "/"
 	finfo, err := os.Stat(dir)
 	if err != nil {
@@ -472,61 +1281,135 @@ func receive(conf *Config, dir string) error {
 		if strings.HasPrefix(tmpFiles[i].Name(), "godiodetmp.") {
 			err = os.Remove(path.Join(tmpDir, tmpFiles[i].Name()))
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to remove tmp file: "+tmpFiles[i].Name()+" "+err.Error()+"\n")
+				r.log.Warn("Failed to remove tmp file", "path", tmpFiles[i].Name(), "err", err)
 			}
 		}
 	}
 
-	maddr, err := net.ResolveUDPAddr("udp", conf.MulticastAddr)
+	c, err := r.listen()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	defer interruptOnDone(ctx, c)()
+
+	v, err := newVerifier(conf, r.metrics)
 	if err != nil {
-		return errors.New("Failed to resolve multicast address: " + err.Error())
+		return err
 	}
-	var nic *net.Interface
-	if conf.NIC != "" {
-		nic, err = net.InterfaceByName(conf.NIC)
+
+	stateFile := conf.StateFile
+	if stateFile == "" {
+		stateFile = path.Join(tmpDir, "godiode-state.json")
+	}
+	replay, err := newReplayGuard(stateFile, conf.Receiver.MaxClockSkew)
+	if err != nil {
+		return err
+	}
+
+	if conf.Receiver.ReportDir != "" {
+		if checkMacSecret(conf, "missing lists") != nil {
+			r.log.Warn("Not writing missing lists without a HMAC secret")
+		}
+		err = os.MkdirAll(conf.Receiver.ReportDir, conf.Receiver.FolderPermission)
 		if err != nil {
-			return errors.New("Failed to resolve nic: " + err.Error())
+			return errors.New("Failed to create report dir: " + err.Error())
 		}
 	}
-	c, err := net.ListenMulticastUDP("udp", nic, maddr)
-	if err != nil {
-		return errors.New("Failed to join multicast address: " + err.Error())
+	var j *journal
+	if conf.Receiver.Journal != "" {
+		j, err = openJournal(conf.Receiver.Journal, conf.Receiver.FilePermission)
+		if err != nil {
+			return err
+		}
+		defer j.Close()
 	}
 
-	err = c.SetReadBuffer(300 * conf.MaxPacketSize)
+	packets := newPacketReader(conf, c, r.log, r.metrics)
+	stopHealth, err := r.monitorHealth(packets, replay)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to set read buffer: "+err.Error()+"\n")
+		return err
 	}
-
-	buff := make([]byte, conf.MaxPacketSize)
-	receiver := Receiver{
-		conf:   conf,
-		dir:    dir,
-		tmpDir: tmpDir,
+	defer stopHealth()
+	receiver := fileReceiver{
+		conf:       conf,
+		log:        r.log,
+		metrics:    r.metrics,
+		verifier:   v,
+		replay:     replay,
+		dir:        dir,
+		tmpDir:     tmpDir,
+		manifests:  map[int]*PendingManifestTransfer{},
+		sessions:   map[int]*fileSession{},
+		journal:    j,
+		commits:    &committer{wake: func() { c.SetReadDeadline(time.Now()) }},
+		onReceived: r.OnFileReceived,
+		onFailed:   r.OnFileFailed,
 	}
 
+	defer receiver.writeReports()
+	defer receiver.commits.collect(true)
+
 	for {
-		read, err := c.Read(buff)
-		if err != nil {
-			log.Fatal("Failed to recv data: " + err.Error())
+		// wake up every second to write the reports of idle sessions
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		buff, err := packets.read()
+		read := len(buff)
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
-		if read < 1 {
+		receiver.commits.collect(false)
+		receiver.expireSessions()
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
 			continue
 		}
+		if err != nil {
+			return errors.New("Failed to recv data: " + err.Error())
+		}
 		ptype := buff[0] & 0xFF
-		if (ptype & 0x80) != 0 { // file transfer data
-			err = receiver.onFileTransferData(buff, read)
-		} else if ptype == 0x02 { // start file transfer
-			err = receiver.onFileTransferStart(buff, read)
-		} else if ptype == 0x03 { // start file transfer
-			err = receiver.onFileTransferComplete(buff, read)
-		} else if ptype == 0x01 { // manifest
+		if ptype == 0x01 { // manifest
 			err = receiver.onManifestPacket(buff, read)
+			if err != nil {
+				r.log.warnErr("Rejected manifest", err)
+			}
+			continue
+		}
+		if ptype != 0x80 && ptype != 0x02 && ptype != 0x03 && ptype != 0x04 {
+			continue
+		}
+		s := receiver.session(buff, read)
+		if s == nil {
+			if ptype == 0x02 {
+				r.log.Warn("Received file transfer start packet without pending manifest")
+			}
+			continue
+		}
+		pkt := buff
+		if conf.EncryptionKey != "" {
+			pkt, read, err = receiver.openPacket(s, buff, read)
+			if pkt == nil {
+				if err != nil {
+					r.log.warnErr("Rejected packet", err, "manifest", hexId(uint32(s.manifestId)), "sender", s.manifest.senderId)
+				}
+				continue
+			}
+		}
+		var msg string
+		if ptype == 0x80 { // file transfer data
+			err = s.onFileTransferData(pkt, read)
+			msg = "Dropped data packet"
+		} else if ptype == 0x02 { // start file transfer
+			err = s.onFileTransferStart(pkt, read)
+			msg = "Dropped file transfer start"
+		} else if ptype == 0x03 { // file transfer complete
+			err = s.onFileTransferComplete(pkt, read)
+			msg = "Dropped file transfer complete"
+		} else if ptype == 0x04 { // file transfer repair
+			err = s.onFileTransferRepair(pkt, read)
+			msg = "Dropped repair packet"
 		}
 		if err != nil {
-			fmt.Fprintf(os.Stderr, err.Error()+"\n")
+			r.log.warnErr(msg, err, "manifest", hexId(uint32(s.manifestId)), "sender", s.manifest.senderId)
 		}
 	}
-
-	return nil
 }
@@ -0,0 +1,360 @@
+package godiode
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const RELAY_HEADER_SIZE = 1 + 4 + 8 + 8 + 2
+
+/**
+ * UDP relay
+ *
+ * Datagrams received on the relay ports of the sender are forwarded as is,
+ * one datagram per packet, and re-emitted by the receiver to the destination
+ * configured for the port. Datagrams are authenticated with the HMAC secret
+ * derived like for manifest signatures, and encrypted like streams, see
+ * stream.go.
+ *
+ * The receiver drops duplicated datagrams by their sequence number, and
+ * replayed ones by their timestamp, checked against the max clock skew. A
+ * relay sender is forgotten once its last datagram is too old to pass the
+ * check, or after the session timeout without datagrams if the check is
+ * disabled. Without the check, a recorded relay sender can be played back
+ * once it has been forgotten.
+ *
+ * relay datagram packet
+ *
+ * type - uint8 - 0x06
+ * relayId - uint32 - random id of the relay sender
+ * seq - uint64 - packet sequence number of the relay sender
+ * timestamp - int64 - sender clock when the datagram was sent (unix millis)
+ * port - uint16 - relay port the datagram was received on
+ * payload - byte[] - the datagram
+ * mac - byte[16] - hmac512 of this packet truncated to 16 bytes, keyed like
+ *   hmac signatures
+ */
+
+type RelayRoute struct {
+	Port    int    `json:"port"`
+	Listen  string `json:"listen"`
+	Forward string `json:"forward"`
+}
+
+// ParseRelayRoutes parses a comma separated list of port=host:port routes
+func ParseRelayRoutes(routes string) ([]RelayRoute, error) {
+	res := []RelayRoute{}
+	for _, r := range strings.Split(routes, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		i := strings.Index(r, "=")
+		if i < 0 {
+			return nil, errors.New("Invalid relay route " + r + ", expected port=host:port")
+		}
+		port, err := strconv.Atoi(r[:i])
+		if err != nil {
+			return nil, errors.New("Invalid relay port in route " + r)
+		}
+		res = append(res, RelayRoute{Port: port, Forward: r[i+1:]})
+	}
+	return res, nil
+}
+
+func checkRelayRoutes(routes []RelayRoute) error {
+	if len(routes) == 0 {
+		return errors.New("No relay routes configured")
+	}
+	ports := map[int]bool{}
+	for _, r := range routes {
+		if r.Port < 1 || r.Port > 65535 {
+			return errors.New("Invalid relay port " + strconv.Itoa(r.Port))
+		}
+		if ports[r.Port] {
+			return errors.New("Duplicate relay port " + strconv.Itoa(r.Port))
+		}
+		ports[r.Port] = true
+	}
+	return nil
+}
+
+type relayWriter struct {
+	lock   sync.Mutex
+	c      *senderConn
+	sc     *sessionCipher
+	mac    *packetMac
+	seq    uint64
+	buff   []byte
+	sealed []byte
+}
+
+func (w *relayWriter) send(port int, data []byte) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if RELAY_HEADER_SIZE+len(data)+STREAM_MAC_SIZE > len(w.buff) {
+		return errors.New("Dropping too large datagram of " + strconv.Itoa(len(data)) + " bytes on relay port " + strconv.Itoa(port))
+	}
+	binary.BigEndian.PutUint64(w.buff[5:], w.seq)
+	w.seq++
+	binary.BigEndian.PutUint64(w.buff[13:], uint64(time.Now().UnixNano()/int64(time.Millisecond)))
+	binary.BigEndian.PutUint16(w.buff[21:], uint16(port))
+	l := RELAY_HEADER_SIZE + copy(w.buff[RELAY_HEADER_SIZE:], data)
+	copy(w.buff[l:], w.mac.sum(w.buff[:l]))
+	l += STREAM_MAC_SIZE
+	pkt := w.buff[:l]
+	if w.sc != nil {
+		w.sealed = sealSalted(w.sc, w.sealed, pkt)
+		pkt = w.sealed
+	}
+	w.c.throttle(len(pkt) + HEADER_OVERHEAD)
+	return w.c.WritePacket(pkt)
+}
+
+// Relay forwards the datagrams received on the relay ports
+func (s *Sender) Relay(ctx context.Context) error {
+	conf := s.conf
+	err := checkRelayRoutes(conf.Relay)
+	if err != nil {
+		return err
+	}
+	err = checkMacSecret(conf, "relays")
+	if err != nil {
+		return err
+	}
+	c, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	stopHeartbeats, err := s.startHeartbeats(c, func() uint64 { return 0 })
+	if err != nil {
+		return err
+	}
+	defer stopHeartbeats()
+
+	id := randomId()
+	w := &relayWriter{
+		c:    c,
+		mac:  newSignerMac(conf.HMACSecret, STREAM_MAC_SIZE),
+		buff: make([]byte, maxPayload(conf)),
+	}
+	if conf.EncryptionKey != "" {
+		w.sc, err = newSenderCipher(conf.EncryptionKey, id)
+		if err != nil {
+			return err
+		}
+		w.buff = w.buff[:maxPayload(conf)-SALT_SIZE-CRYPTO_OVERHEAD]
+	}
+	w.buff[0] = 0x06
+	binary.BigEndian.PutUint32(w.buff[1:], id)
+
+	errc := make(chan error, len(conf.Relay))
+	for _, r := range conf.Relay {
+		listen := r.Listen
+		if listen == "" {
+			listen = ":" + strconv.Itoa(r.Port)
+		}
+		addr, err := net.ResolveUDPAddr("udp", listen)
+		if err != nil {
+			return err
+		}
+		l, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return errors.New("Failed to listen on relay port " + strconv.Itoa(r.Port) + ": " + err.Error())
+		}
+		defer l.Close()
+		s.log.Info("Relaying datagrams", "listen", l.LocalAddr().String(), "port", r.Port)
+		go func(port int) {
+			buff := make([]byte, 65536)
+			for {
+				read, err := l.Read(buff)
+				if err != nil {
+					errc <- errors.New("Failed to read relay port " + strconv.Itoa(port) + ": " + err.Error())
+					return
+				}
+				err = w.send(port, buff[:read])
+				if err != nil {
+					s.log.Error("Failed to relay datagram", "port", port, "err", err)
+				}
+			}
+		}(r.Port)
+	}
+	select {
+	case err = <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// relayWindow drops duplicated datagrams, remembering the last 64 sequence
+// numbers of a relay sender
+type relayWindow struct {
+	last uint64
+	seen uint64
+	// newest timestamp accepted
+	newest   int64
+	lastSeen time.Time
+}
+
+func (w *relayWindow) accept(seq uint64) bool {
+	if seq > w.last {
+		if seq-w.last >= 64 {
+			w.seen = 1
+		} else {
+			w.seen = w.seen<<(seq-w.last) | 1
+		}
+		w.last = seq
+		return true
+	}
+	d := w.last - seq
+	if d >= 64 || w.seen&(1<<d) != 0 {
+		return false
+	}
+	w.seen |= 1 << d
+	return true
+}
+
+// relayWindows keeps the windows of the relay senders, by relay id
+type relayWindows struct {
+	conf      *Config
+	windows   map[uint32]*relayWindow
+	lastSweep time.Time
+}
+
+func newRelayWindows(conf *Config) *relayWindows {
+	return &relayWindows{conf: conf, windows: map[uint32]*relayWindow{}, lastSweep: time.Now()}
+}
+
+// accept reports whether the datagram was not seen before, and fails for
+// datagrams off by more than the max clock skew
+func (r *relayWindows) accept(id uint32, seq uint64, timestamp int64) (bool, error) {
+	err := checkClockSkew(r.conf, timestamp)
+	if err != nil {
+		return false, withFields(err, "relay", hexId(id))
+	}
+	w := r.windows[id]
+	if w == nil {
+		w = &relayWindow{}
+		r.windows[id] = w
+	}
+	// offset by one as the window starts at 0
+	if !w.accept(seq + 1) {
+		return false, nil
+	}
+	if timestamp > w.newest {
+		w.newest = timestamp
+	}
+	w.lastSeen = time.Now()
+	return true, nil
+}
+
+// sweep forgets relay senders whose datagrams can no longer pass the clock
+// skew check, or that were idle for the session timeout without a check
+func (r *relayWindows) sweep() {
+	if time.Since(r.lastSweep) < time.Second {
+		return
+	}
+	r.lastSweep = time.Now()
+	maxSkew := time.Duration(r.conf.Receiver.MaxClockSkew) * time.Second
+	for id, w := range r.windows {
+		if maxSkew > 0 && time.Since(time.Unix(0, w.newest*int64(time.Millisecond))) > maxSkew {
+			delete(r.windows, id)
+		} else if maxSkew <= 0 && time.Since(w.lastSeen) > SESSION_TIMEOUT {
+			delete(r.windows, id)
+		}
+	}
+}
+
+// Relay re-emits relayed datagrams to the destinations of their ports
+func (r *Receiver) Relay(ctx context.Context) error {
+	conf := r.conf
+	err := checkRelayRoutes(conf.Relay)
+	if err != nil {
+		return err
+	}
+	err = checkMacSecret(conf, "relays")
+	if err != nil {
+		return err
+	}
+	dests := map[uint16]*net.UDPConn{}
+	for _, route := range conf.Relay {
+		addr, err := net.ResolveUDPAddr("udp", route.Forward)
+		if err != nil {
+			return errors.New("Invalid relay destination for port " + strconv.Itoa(route.Port) + ": " + err.Error())
+		}
+		d, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			return err
+		}
+		defer d.Close()
+		dests[uint16(route.Port)] = d
+		r.log.Info("Relaying port", "port", route.Port, "forward", addr.String())
+	}
+
+	c, err := r.listen()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	defer interruptOnDone(ctx, c)()
+
+	o := newStreamOpener(conf, r.metrics)
+	windows := newRelayWindows(conf)
+	packets := newPacketReader(conf, c, r.log, r.metrics)
+	stopHealth, err := r.monitorHealth(packets, nil)
+	if err != nil {
+		return err
+	}
+	defer stopHealth()
+	for {
+		buff, err := packets.read()
+		read := len(buff)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return errors.New("Failed to recv data: " + err.Error())
+		}
+		windows.sweep()
+		if read < 1 || buff[0] != 0x06 {
+			continue
+		}
+		pkt, err := o.authenticate(buff, read)
+		if err != nil {
+			r.log.warnErr("Rejected relay packet", err)
+			continue
+		}
+		if len(pkt) < RELAY_HEADER_SIZE {
+			r.log.Warn("Received truncated relay packet")
+			continue
+		}
+		id := binary.BigEndian.Uint32(pkt[1:])
+		seq := binary.BigEndian.Uint64(pkt[5:])
+		fresh, err := windows.accept(id, seq, int64(binary.BigEndian.Uint64(pkt[13:])))
+		if err != nil {
+			r.log.warnErr("Rejected relay packet", err)
+			continue
+		}
+		if !fresh {
+			continue
+		}
+		port := binary.BigEndian.Uint16(pkt[21:])
+		d := dests[port]
+		if d == nil {
+			r.log.Warn("Dropping relayed datagram for unknown port", "port", port)
+			continue
+		}
+		_, err = d.Write(pkt[RELAY_HEADER_SIZE:])
+		if err != nil {
+			r.log.Error("Failed to forward datagram", "port", port, "err", err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package godiode
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRelayMac(t *testing.T) {
+	conf := testConfig(t)
+	n := NewMemoryNetwork(Impairment{})
+	packets := newPacketReader(conf, n.Listen(), &Logger{out: ioutil.Discard}, NewMetrics())
+	o := newStreamOpener(conf, NewMetrics())
+	// keyed like signatures, not like data MACs
+	for _, mac := range []struct {
+		mac   *packetMac
+		valid bool
+	}{
+		{newSignerMac(conf.HMACSecret, STREAM_MAC_SIZE), true},
+		{newPacketMac(conf.HMACSecret, STREAM_MAC_SIZE), false},
+	} {
+		w := &relayWriter{c: &senderConn{Transport: n.Dial(), metrics: NewMetrics()}, mac: mac.mac, buff: make([]byte, maxPayload(conf))}
+		w.buff[0] = 0x06
+		binary.BigEndian.PutUint32(w.buff[1:], 1)
+		if err := w.send(514, []byte("datagram")); err != nil {
+			t.Fatal(err)
+		}
+		buff, err := packets.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = o.authenticate(buff, len(buff))
+		if mac.valid && err != nil {
+			t.Errorf("rejected datagram: %v", err)
+		}
+		if !mac.valid && err == nil {
+			t.Error("accepted datagram with a data MAC")
+		}
+	}
+}
+
+func TestRelay(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("no loopback: " + err.Error())
+	}
+	defer collector.Close()
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := l.LocalAddr().String()
+	l.Close()
+	_, p, _ := net.SplitHostPort(listen)
+	port, _ := strconv.Atoi(p)
+
+	conf := testConfig(t)
+	conf.EncryptionKey = "test key"
+	conf.Relay = []RelayRoute{{Port: port, Listen: listen, Forward: collector.LocalAddr().String()}}
+	n := NewMemoryNetwork(Impairment{})
+	r, err := NewReceiver(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Transport = n.Listen()
+	s, err := NewSender(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Transport = n.Dial()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Relay(ctx)
+	go s.Relay(ctx)
+
+	src, err := net.Dial("udp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	buff := make([]byte, 100)
+	timeout := time.Now().Add(10 * time.Second)
+	for time.Now().Before(timeout) {
+		// the relay sender may not listen yet
+		src.Write([]byte("<13>syslog"))
+		collector.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		read, _, err := collector.ReadFrom(buff)
+		if err == nil {
+			if string(buff[:read]) != "<13>syslog" {
+				t.Fatalf("relayed %q", buff[:read])
+			}
+			return
+		}
+	}
+	t.Fatal("datagram not relayed")
+}
+
+func TestRelayWindows(t *testing.T) {
+	conf := testConfig(t)
+	conf.Receiver.MaxClockSkew = 1
+	r := newRelayWindows(conf)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if fresh, err := r.accept(1, 0, now); !fresh || err != nil {
+		t.Fatalf("rejected datagram: %v", err)
+	}
+	if fresh, err := r.accept(1, 0, now); fresh || err != nil {
+		t.Fatalf("accepted duplicated datagram: %v", err)
+	}
+	// a recorded relay sender played back with a new relay id
+	if _, err := r.accept(2, 0, now-2000); err == nil {
+		t.Fatal("accepted replayed datagram")
+	}
+	r.windows[1].newest = now - 2000
+	r.lastSweep = time.Time{}
+	r.sweep()
+	if len(r.windows) != 0 {
+		t.Fatalf("kept %d windows of relay senders too old to pass the skew check", len(r.windows))
+	}
+}
@@ -0,0 +1,241 @@
+package godiode
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+/**
+ * Replay protection
+ *
+ * Every manifest carries the sender id, a timestamp and a sequence number
+ * that increases for every session of the sender. The receiver keeps the last
+ * REPLAY_WINDOW sequence numbers accepted per sender in a state file, along
+ * with a floor at or below which all are rejected, and rejects manifests seen
+ * before, or whose timestamp is off by more than the allowed clock skew. The
+ * window lets the sessions of overlapping sends of one sender arrive in any
+ * order. The last heartbeat timestamp of every sender is kept in the same
+ * state file, see heartbeat.go.
+ *
+ * Stream packets carry a timestamp too, checked against the allowed clock
+ * skew. The ids of streams received are kept in the state file until their
+ * packets are too old to pass the check, and new streams with a kept id are
+ * rejected.
+ */
+
+// sequence numbers accepted per sender kept above the floor
+const REPLAY_WINDOW = 64
+
+// max stream ids kept, the oldest is dropped
+const REPLAY_STREAMS = 1024
+
+type senderState struct {
+	Sequence uint64 `json:"sequence"`
+}
+
+type receiverState struct {
+	// floor of the sequence numbers of every sender
+	Senders map[string]uint64 `json:"senders"`
+	// sequence numbers accepted above the floor
+	Recent     map[string][]uint64 `json:"recent,omitempty"`
+	Heartbeats map[string]int64    `json:"heartbeats,omitempty"`
+	// timestamps of the first packets of the streams received, by stream id
+	Streams map[string]int64 `json:"streams,omitempty"`
+}
+
+func readState(file string, state interface{}) error {
+	data, err := ioutil.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, state)
+}
+
+func writeState(file string, state interface{}) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(file+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// nextSequence returns the sequence number for a new manifest session. It
+// follows the clock but never goes backwards when a state file is used.
+func nextSequence(stateFile string) (uint64, error) {
+	seq := uint64(time.Now().UnixNano())
+	if stateFile == "" {
+		return seq, nil
+	}
+	state := senderState{}
+	err := readState(stateFile, &state)
+	if err != nil {
+		return 0, errors.New("Failed to read sender state: " + err.Error())
+	}
+	if seq <= state.Sequence {
+		seq = state.Sequence + 1
+	}
+	state.Sequence = seq
+	err = writeState(stateFile, &state)
+	if err != nil {
+		return 0, errors.New("Failed to write sender state: " + err.Error())
+	}
+	return seq, nil
+}
+
+type replayGuard struct {
+	lock      sync.Mutex
+	stateFile string
+	maxSkew   time.Duration
+	state     receiverState
+}
+
+func newReplayGuard(stateFile string, maxSkew int) (*replayGuard, error) {
+	g := &replayGuard{stateFile: stateFile, maxSkew: time.Duration(maxSkew) * time.Second}
+	err := readState(stateFile, &g.state)
+	if err != nil {
+		return nil, errors.New("Failed to read receiver state: " + err.Error())
+	}
+	if g.state.Senders == nil {
+		g.state.Senders = map[string]uint64{}
+	}
+	if g.state.Recent == nil {
+		g.state.Recent = map[string][]uint64{}
+	}
+	if g.state.Heartbeats == nil {
+		g.state.Heartbeats = map[string]int64{}
+	}
+	if g.state.Streams == nil {
+		g.state.Streams = map[string]int64{}
+	}
+	return g, nil
+}
+
+// accept checks that the manifest was not seen before from the sender and
+// persists its sequence number
+func (g *replayGuard) accept(m *Manifest) error {
+	if g.maxSkew > 0 {
+		skew := time.Since(time.Unix(0, m.timestamp*int64(time.Millisecond)))
+		if math.Abs(float64(skew)) > float64(g.maxSkew) {
+			return fieldErr("Manifest timestamp off by more than the max clock skew", "sender", m.senderId, "skew", skew.Round(time.Second).String())
+		}
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	floor, exists := g.state.Senders[m.senderId]
+	if exists && m.sequence <= floor {
+		return fieldErr("Replayed manifest, sequence not after the floor", "sender", m.senderId, "sequence", m.sequence, "floor", floor)
+	}
+	recent := g.state.Recent[m.senderId]
+	for _, seq := range recent {
+		if seq == m.sequence {
+			return fieldErr("Replayed manifest, sequence already received", "sender", m.senderId, "sequence", m.sequence)
+		}
+	}
+	recent = append(recent, m.sequence)
+	sort.Slice(recent, func(i, j int) bool { return recent[i] < recent[j] })
+	if len(recent) > REPLAY_WINDOW {
+		// the oldest sequence leaves the window and becomes the floor
+		g.state.Senders[m.senderId] = recent[0]
+		recent = recent[1:]
+	}
+	g.state.Recent[m.senderId] = recent
+	err := writeState(g.stateFile, &g.state)
+	if err != nil {
+		return errors.New("Failed to write receiver state: " + err.Error())
+	}
+	return nil
+}
+
+// otherSenders reports whether manifests of senders other than id were
+// accepted
+func (g *replayGuard) otherSenders(id string) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for other := range g.state.Recent {
+		if other != id {
+			return true
+		}
+	}
+	for other := range g.state.Senders {
+		if other != id {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptHeartbeat checks that the heartbeat timestamp is newer than the last
+// one of the sender and persists it
+func (g *replayGuard) acceptHeartbeat(senderId string, timestamp int64) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	last, exists := g.state.Heartbeats[senderId]
+	if exists && timestamp <= last {
+		return fieldErr("Replayed heartbeat", "sender", senderId)
+	}
+	g.state.Heartbeats[senderId] = timestamp
+	if g.stateFile == "" {
+		return nil
+	}
+	err := writeState(g.stateFile, &g.state)
+	if err != nil {
+		return errors.New("Failed to write receiver state: " + err.Error())
+	}
+	return nil
+}
+
+// checkClockSkew rejects timestamps off by more than the max clock skew
+func checkClockSkew(conf *Config, timestamp int64) error {
+	maxSkew := time.Duration(conf.Receiver.MaxClockSkew) * time.Second
+	skew := time.Since(time.Unix(0, timestamp*int64(time.Millisecond)))
+	if maxSkew > 0 && (skew > maxSkew || -skew > maxSkew) {
+		return errors.New("Timestamp off by " + skew.Round(time.Second).String())
+	}
+	return nil
+}
+
+// acceptStream checks that no stream with the id was received before and
+// persists it with its timestamp
+func (g *replayGuard) acceptStream(id uint32, timestamp int64) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	key := hexId(id)
+	if _, exists := g.state.Streams[key]; exists {
+		return fieldErr("Replayed stream", "stream", key)
+	}
+	// streams too old to pass the clock skew check need not be kept
+	oldest := ""
+	for k, ts := range g.state.Streams {
+		if g.maxSkew > 0 && time.Since(time.Unix(0, ts*int64(time.Millisecond))) > g.maxSkew {
+			delete(g.state.Streams, k)
+		} else if oldest == "" || ts < g.state.Streams[oldest] {
+			oldest = k
+		}
+	}
+	if len(g.state.Streams) >= REPLAY_STREAMS {
+		delete(g.state.Streams, oldest)
+	}
+	g.state.Streams[key] = timestamp
+	if g.stateFile == "" {
+		return nil
+	}
+	err := writeState(g.stateFile, &g.state)
+	if err != nil {
+		return errors.New("Failed to write receiver state: " + err.Error())
+	}
+	return nil
+}
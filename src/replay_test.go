@@ -0,0 +1,127 @@
+package godiode
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func sequencedManifest(sender string, seq uint64) *Manifest {
+	return &Manifest{senderId: sender, timestamp: time.Now().UnixMilli(), sequence: seq}
+}
+
+func TestReplayGuardAccept(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	g, err := newReplayGuard(stateFile, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// out of order within the window
+	for _, seq := range []uint64{10, 12, 11} {
+		if err := g.accept(sequencedManifest("a", seq)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if g.accept(sequencedManifest("a", 12)) == nil {
+		t.Error("accepted duplicate sequence")
+	}
+	if err := g.accept(sequencedManifest("b", 12)); err != nil {
+		t.Errorf("rejected the sequence of another sender: %v", err)
+	}
+
+	// fill the window so the oldest sequences become the floor
+	for seq := uint64(100); seq < 100+REPLAY_WINDOW; seq++ {
+		if err := g.accept(sequencedManifest("a", seq)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	floor := g.state.Senders["a"]
+	if floor != 12 {
+		t.Fatalf("expected floor 12, got %d", floor)
+	}
+	for _, seq := range []uint64{5, 11, 12} {
+		if g.accept(sequencedManifest("a", seq)) == nil {
+			t.Errorf("accepted sequence %d at or below the floor", seq)
+		}
+	}
+
+	stale := sequencedManifest("a", 1000)
+	stale.timestamp = time.Now().Add(-time.Hour).UnixMilli()
+	if g.accept(stale) == nil {
+		t.Error("accepted stale timestamp")
+	}
+	future := sequencedManifest("a", 1001)
+	future.timestamp = time.Now().Add(time.Hour).UnixMilli()
+	if g.accept(future) == nil {
+		t.Error("accepted timestamp in the future")
+	}
+
+	// a restarted receiver keeps the floor and the window
+	g, err = newReplayGuard(stateFile, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.state.Senders["a"] != floor {
+		t.Errorf("floor %d not kept, got %d", floor, g.state.Senders["a"])
+	}
+	for _, seq := range []uint64{12, 100, 100 + REPLAY_WINDOW - 1} {
+		if g.accept(sequencedManifest("a", seq)) == nil {
+			t.Errorf("accepted sequence %d after reload", seq)
+		}
+	}
+	if g.accept(sequencedManifest("b", 12)) == nil {
+		t.Error("accepted sequence of another sender after reload")
+	}
+	if err := g.accept(sequencedManifest("a", 50)); err != nil {
+		t.Errorf("rejected a new sequence in the window after reload: %v", err)
+	}
+}
+
+func TestReplayedTransferRejected(t *testing.T) {
+	conf := testConfig(t)
+	conf.Sender.HeartbeatInterval = 0
+	conf.StateFile = filepath.Join(t.TempDir(), "state.json")
+	src := t.TempDir()
+	tree := testTree()
+	writeTree(t, src, tree)
+
+	n := NewMemoryNetwork(Impairment{})
+	capture := n.Listen()
+	r := startReceiver(t, conf, n.Listen(), t.TempDir())
+	send(t, conf, n.Dial(), src)
+	r.waitReceived(t, len(tree))
+	r.stop()
+
+	packets := [][]byte{}
+	buff := make([]byte, conf.MaxPacketSize)
+	for {
+		capture.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		read, err := capture.ReadPacket(buff)
+		if err != nil {
+			break
+		}
+		packets = append(packets, append([]byte{}, buff[:read]...))
+	}
+	if len(packets) == 0 {
+		t.Fatal("no packets recorded")
+	}
+
+	// the recorded transfer played back to a restarted receiver
+	replay := NewMemoryNetwork(Impairment{})
+	dst := t.TempDir()
+	r = startReceiver(t, conf, replay.Listen(), dst)
+	w := replay.Dial()
+	for _, p := range packets {
+		if err := w.WritePacket(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case e := <-r.received:
+		t.Fatalf("replayed file %s received", e.Path)
+	case <-time.After(500 * time.Millisecond):
+	}
+	if files := readTree(t, dst); len(files) > 0 {
+		t.Fatalf("receive dir not empty: %v", files)
+	}
+}
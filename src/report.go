@@ -0,0 +1,235 @@
+package godiode
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/**
+ * Transfer reports
+ *
+ * The receiver keeps the status of every file of a manifest session, and
+ * writes it to a JSON report in the report dir when the session has been idle
+ * for the report timeout, when the next manifest of the same sender arrives
+ * and when the receiver stops. The report is rewritten if the status changes
+ * afterwards, e.g. by a later transmission round. Sessions resending the
+ * missing files of an earlier session update the report of that session,
+ * where a file once received stays received. The files not received are also
+ * written to a missing list next to the report, see missing.go.
+ *
+ * Committed files are also appended to the journal, one JSON object per line.
+ */
+
+const (
+	FILE_STATUS_RECEIVED = "received"
+	FILE_STATUS_FAILED   = "failed"
+	FILE_STATUS_MISSING  = "missing"
+)
+
+type fileReport struct {
+	Index    int    `json:"index"`
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	Status   string `json:"status"`
+	Checksum string `json:"checksum,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type sessionReport struct {
+	Manifest string `json:"manifest"`
+	Sender   string `json:"sender"`
+	Sequence uint64 `json:"sequence"`
+	// creation time of the manifest, by the sender clock
+	Created  time.Time    `json:"created"`
+	Started  time.Time    `json:"started"`
+	Updated  time.Time    `json:"updated"`
+	Received int          `json:"received"`
+	Failed   int          `json:"failed"`
+	Missing  int          `json:"missing"`
+	Files    []fileReport `json:"files"`
+}
+
+// transferStatus tracks the files of a session, updated by the receive loop
+// and the goroutines committing files
+type transferStatus struct {
+	lock    sync.Mutex
+	files   []fileReport
+	started time.Time
+	// changed since the report was written
+	dirty bool
+}
+
+func newTransferStatus(m *Manifest) *transferStatus {
+	t := &transferStatus{files: make([]fileReport, len(m.files)), started: time.Now(), dirty: true}
+	for i, f := range m.files {
+		t.files[i] = fileReport{Index: i, Path: f.path, Size: f.size, Status: FILE_STATUS_MISSING}
+	}
+	return t
+}
+
+func (t *transferStatus) update(index int, status string, checksum string, reason string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	f := &t.files[index]
+	if f.Status == FILE_STATUS_RECEIVED {
+		return
+	}
+	f.Status = status
+	f.Checksum = checksum
+	f.Reason = reason
+	t.dirty = true
+}
+
+// origin returns the id and timestamp of the manifest reported, the original
+// one for resends
+func (s *fileSession) origin() (uint32, int64) {
+	if s.manifest.features&FEATURE_RESEND != 0 {
+		return s.manifest.originId, s.manifest.originTimestamp
+	}
+	return uint32(s.manifestId), s.manifest.timestamp
+}
+
+// reportFile returns the path of the report of the session, or of the missing
+// list with ext .txt, sorting by the manifest creation time
+func (s *fileSession) reportFile(prefix string, ext string) string {
+	id, ts := s.origin()
+	return path.Join(s.conf.Receiver.ReportDir, prefix+"-"+strconv.FormatInt(ts, 10)+"-"+hexId(id)+ext)
+}
+
+// mergeFiles updates the files of an earlier report of the same manifest with
+// the status of files, received files stay received
+func mergeFiles(prev []fileReport, files []fileReport) []fileReport {
+	merged := append([]fileReport{}, prev...)
+	index := map[string]int{}
+	for i := range merged {
+		index[merged[i].Path] = i
+	}
+	for _, f := range files {
+		i, exists := index[f.Path]
+		if !exists {
+			merged = append(merged, f)
+			continue
+		}
+		if merged[i].Status == FILE_STATUS_RECEIVED || f.Status == FILE_STATUS_MISSING {
+			continue
+		}
+		f.Index = merged[i].Index
+		merged[i] = f
+	}
+	return merged
+}
+
+// writeReport writes the report of the session if it changed since it was
+// last written
+func (s *fileSession) writeReport() {
+	if s.conf.Receiver.ReportDir == "" {
+		return
+	}
+	t := s.status
+	t.lock.Lock()
+	if !t.dirty {
+		t.lock.Unlock()
+		return
+	}
+	t.dirty = false
+	files := append([]fileReport{}, t.files...)
+	t.lock.Unlock()
+
+	id, ts := s.origin()
+	file := s.reportFile("report", ".json")
+	r := sessionReport{}
+	err := readState(file, &r)
+	if err != nil || r.Manifest != hexId(id) {
+		r = sessionReport{
+			Manifest: hexId(id),
+			Sender:   s.manifest.senderId,
+			Sequence: s.manifest.sequence,
+			Created:  time.Unix(0, ts*int64(time.Millisecond)),
+			Started:  t.started,
+		}
+	}
+	r.Files = mergeFiles(r.Files, files)
+	r.Updated = time.Now()
+	r.Received, r.Failed, r.Missing = 0, 0, 0
+	for i := range r.Files {
+		switch r.Files[i].Status {
+		case FILE_STATUS_RECEIVED:
+			r.Received++
+		case FILE_STATUS_FAILED:
+			r.Failed++
+		default:
+			r.Missing++
+		}
+	}
+	err = writeState(file, &r)
+	if err != nil {
+		s.log.Error("Failed to write report", "manifest", r.Manifest, "path", file, "err", err)
+		return
+	}
+	s.log.Info("Wrote report", "manifest", r.Manifest, "sender", r.Sender, "path", file, "received", r.Received, "failed", r.Failed, "missing", r.Missing)
+
+	list := &MissingList{Manifest: id, Created: ts, Sender: r.Sender}
+	for _, f := range r.Files {
+		if f.Status != FILE_STATUS_RECEIVED {
+			list.Files = append(list.Files, f.Path)
+		}
+	}
+	file = s.reportFile("missing", ".txt")
+	if len(list.Files) == 0 {
+		os.Remove(file)
+		return
+	}
+	// an empty key would make the list forgeable
+	if checkMacSecret(s.conf, "missing lists") != nil {
+		return
+	}
+	err = ioutil.WriteFile(file, list.marshal(s.conf.HMACSecret), 0600)
+	if err != nil {
+		s.log.Error("Failed to write missing list", "manifest", r.Manifest, "path", file, "err", err)
+	}
+}
+
+type journalEntry struct {
+	Time     time.Time `json:"time"`
+	Manifest string    `json:"manifest"`
+	Sender   string    `json:"sender"`
+	File     int       `json:"file"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Checksum string    `json:"checksum"`
+}
+
+// journal is the append only list of all files committed
+type journal struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+func openJournal(file string, perm os.FileMode) (*journal, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, perm)
+	if err != nil {
+		return nil, errors.New("Failed to open journal: " + err.Error())
+	}
+	return &journal{file: f}, nil
+}
+
+func (j *journal) append(e *journalEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	_, err = j.file.Write(append(data, '\n'))
+	return err
+}
+
+func (j *journal) Close() error {
+	return j.file.Close()
+}
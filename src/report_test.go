@@ -0,0 +1,162 @@
+package godiode
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func readReports(t *testing.T, dir string) []sessionReport {
+	t.Helper()
+	files, err := filepath.Glob(path.Join(dir, "report-*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports := []sessionReport{}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r sessionReport
+		err = json.Unmarshal(data, &r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reports = append(reports, r)
+	}
+	return reports
+}
+
+func TestReportAndJournal(t *testing.T) {
+	conf := testConfig(t)
+	conf.Receiver.ReportDir = t.TempDir()
+	conf.Receiver.Journal = path.Join(t.TempDir(), "journal")
+	src := t.TempDir()
+	tree := testTree()
+	writeTree(t, src, tree)
+
+	n := NewMemoryNetwork(Impairment{})
+	r := startReceiver(t, conf, n.Listen(), t.TempDir())
+	send(t, conf, n.Dial(), src)
+	r.waitReceived(t, len(tree))
+	// reports of sessions not idle yet are written when the receiver stops
+	r.stop()
+
+	reports := readReports(t, conf.Receiver.ReportDir)
+	if len(reports) != 1 {
+		t.Fatalf("%d reports", len(reports))
+	}
+	report := reports[0]
+	if report.Received != len(tree) || report.Failed != 0 || report.Missing != 0 || len(report.Files) != len(tree) {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	for _, f := range report.Files {
+		h := sha256.Sum256(tree[f.Path])
+		if f.Status != FILE_STATUS_RECEIVED || f.Checksum != hex.EncodeToString(h[:]) || f.Size != int64(len(tree[f.Path])) {
+			t.Errorf("unexpected file report %+v", f)
+		}
+	}
+
+	jf, err := os.Open(conf.Receiver.Journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jf.Close()
+	committed := map[string]bool{}
+	sc := bufio.NewScanner(jf)
+	for sc.Scan() {
+		var e journalEntry
+		err = json.Unmarshal(sc.Bytes(), &e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Manifest != report.Manifest || e.Checksum == "" {
+			t.Errorf("unexpected journal entry %s", sc.Text())
+		}
+		committed[e.Path] = true
+	}
+	if len(committed) != len(tree) {
+		t.Errorf("%d files in the journal, expected %d", len(committed), len(tree))
+	}
+}
+
+func TestReportStatus(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Logger = &Logger{out: ioutil.Discard}
+	conf.Receiver.ReportDir = t.TempDir()
+	m := &Manifest{senderId: "sender", timestamp: 1600000000000, files: []FileRecord{{DirRecord{"a", 0}, 1}, {DirRecord{"b", 0}, 2}, {DirRecord{"c", 0}, 3}}}
+	s := &fileSession{conf: &conf, log: conf.Logger, metrics: NewMetrics(), manifest: m, manifestId: 0xbeef, status: newTransferStatus(m)}
+	s.status.update(0, FILE_STATUS_RECEIVED, "abcd", "")
+	s.fileFailed(&PendingFileTransfer{fileIndex: 1, path: "b"}, errors.New("Data checksum error"))
+	// a received file stays received
+	s.status.update(0, FILE_STATUS_FAILED, "", "late failure")
+	s.writeReport()
+
+	reports := readReports(t, conf.Receiver.ReportDir)
+	if len(reports) != 1 {
+		t.Fatalf("%d reports", len(reports))
+	}
+	r := reports[0]
+	if r.Manifest != "beef" || r.Sender != "sender" || r.Received != 1 || r.Failed != 1 || r.Missing != 1 {
+		t.Fatalf("unexpected report %+v", r)
+	}
+	expected := []fileReport{
+		{0, "a", 1, FILE_STATUS_RECEIVED, "abcd", ""},
+		{1, "b", 2, FILE_STATUS_FAILED, "", "Data checksum error"},
+		{2, "c", 3, FILE_STATUS_MISSING, "", ""},
+	}
+	for i := range expected {
+		if r.Files[i] != expected[i] {
+			t.Errorf("file %d is %+v, expected %+v", i, r.Files[i], expected[i])
+		}
+	}
+
+	// unchanged reports are not written again
+	os.Remove(s.reportFile("report", ".json"))
+	s.writeReport()
+	if _, err := os.Stat(s.reportFile("report", ".json")); err == nil {
+		t.Error("rewrote unchanged report")
+	}
+}
+
+func TestFailedMoveNotCompleted(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Logger = &Logger{out: ioutil.Discard}
+	dir := t.TempDir()
+	m := &Manifest{senderId: "sender", files: []FileRecord{{DirRecord{"a", 0}, 4}}}
+	s := &fileSession{conf: &conf, log: conf.Logger, metrics: NewMetrics(), manifest: m, manifestId: 0xbeef, status: newTransferStatus(m),
+		completedTransfers: map[fileTransferKey]bool{}, movingTransfers: map[fileTransferKey]bool{}, commits: &committer{wake: func() {}}}
+	key := fileTransferKey{0xbeef, 0}
+	pft := &PendingFileTransfer{fileIndex: 0, path: "a", filename: path.Join(dir, "a"), hash: sha256.New()}
+	tmpFile := path.Join(dir, "a.tmp")
+	if err := ioutil.WriteFile(tmpFile, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// a dir in the way fails the move
+	if err := os.MkdirAll(path.Join(dir, "a", "blocker"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	s.movingTransfers[key] = true
+	s.commits.commit(s, pft, tmpFile)
+	s.commits.collect(true)
+	if s.completedTransfers[key] || s.movingTransfers[key] || s.status.files[0].Status != FILE_STATUS_FAILED {
+		t.Fatal("failed move completed the file")
+	}
+
+	os.RemoveAll(path.Join(dir, "a"))
+	s.movingTransfers[key] = true
+	s.commits.commit(s, pft, tmpFile)
+	s.commits.collect(true)
+	if !s.completedTransfers[key] || s.movingTransfers[key] || s.status.files[0].Status != FILE_STATUS_RECEIVED {
+		t.Fatal("moved file not completed")
+	}
+}
@@ -1,41 +1,57 @@
-package main
+package godiode
 
 import (
-	"crypto/hmac"
+	"context"
 	"crypto/sha256"
-	"crypto/sha512"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
-	"fmt"
 	"io"
 	"math"
-	"math/rand"
-	"net"
 	"os"
 	"path"
+	"sync"
 	"time"
 )
 
 const HEADER_OVERHEAD = 6 + 6 + 2 + 4 + 20 + 8
 
-var THROTTLE = struct {
+const DATA_HEADER_SIZE = 1 + 4 + 4 + 8
+
+const REPAIR_HEADER_SIZE = 1 + 4 + 4 + 4 + 1
+
+// senderConn is the sender transport with its bandwidth throttle, shared by
+// the connections of the proxy
+type senderConn struct {
+	// first for 64-bit alignment of atomic access
+	sent counter
+	Transport
+	log        *Logger
+	metrics    *Metrics
+	wlock      sync.Mutex
+	wbuff      []byte
+	lock       sync.Mutex
 	enabled    bool
 	tokens     int64
 	capacity   int64
 	last       time.Time
 	nsPerToken float64
-}{}
+}
 
 /**
  * Protocol format
  *
  * | type | payload... |
+ * after the protocol header, see protocol.go
  * type - uint8
+ *   0x00 - heartbeat, see heartbeat.go
  *   0x01 - manifest
  *   0x02 - file transfer start
  *   0x03 - file transfer complete
- *   0x80-0xFF - file transfer data
+ *   0x04 - file transfer repair (FEC)
+ *   0x05 - stream data, see stream.go
+ *   0x06 - relay datagram, see relay.go
+ *   0x80 - file transfer data
  *
  * manifest
  * | type | id | part | [size] | payload
@@ -43,23 +59,25 @@ var THROTTLE = struct {
  * id - uint32 - manifest session id
  * part - uint16 - manifest session part index
  * size - uint32 - total manifest size, only sent in part 0
- * payload | manifest chunk
+ * payload | manifest chunk, of the manifest serialized as in manifest.go and
+ *   encrypted as in crypto.go if enabled
  *
  */
 
-func sendManifest(conf *Config, c *net.UDPConn, manifest *Manifest, manifestId uint32) error {
-	if conf.Verbose {
-		fmt.Println("Sending manifest")
-	}
+func sendManifest(conf *Config, c *senderConn, manifest *Manifest, manifestId uint32, sc *sessionCipher, sig signer) error {
+	c.log.Debug("Sending manifest", "manifest", hexId(manifestId))
 
-	if conf.MaxPacketSize < 14 {
+	if maxPayload(conf) < 14 {
 		return errors.New("Too small packet max size for sending manifest")
 	}
-	manifestData, err := manifest.serializeManifest(conf.HMACSecret)
+	manifestData, err := manifest.serializeManifest(sig)
 	if err != nil {
 		return err
 	}
-	buff := make([]byte, conf.MaxPacketSize)
+	if sc != nil {
+		manifestData = sc.sealManifest(manifestData)
+	}
+	buff := make([]byte, maxPayload(conf))
 	buff[0] = 0x01
 	binary.BigEndian.PutUint32(buff[1:], manifestId)
 
@@ -78,22 +96,89 @@ func sendManifest(conf *Config, c *net.UDPConn, manifest *Manifest, manifestId u
 			l += copied
 			offset += copied
 		}
-		c.Write(buff[:l])
+		c.WritePacket(buff[:l])
 		time.Sleep(50 * time.Millisecond)
 	}
 	return nil
 }
 
+// writePacket sends the packet, sealed with the session cipher if encryption
+// is enabled
+func writePacket(c *senderConn, sc *sessionCipher, pkt []byte, hdrLen int) {
+	if sc != nil {
+		sc.buff = sc.seal(sc.buff, pkt, hdrLen)
+		pkt = sc.buff
+	}
+	c.WritePacket(pkt)
+}
+
+func (c *senderConn) throttle(plen int) {
+	if !c.enabled {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for {
+		if c.tokens >= int64(plen) {
+			c.tokens -= int64(plen)
+			break
+		}
+		now := time.Now()
+		ns := time.Duration.Nanoseconds(now.Sub(c.last))
+		//log.Println(ns, ns/c.nsPerToken, c.tokens)
+		newValue := c.tokens + int64(math.Round(float64(ns)/c.nsPerToken))
+		if newValue >= int64(plen) {
+			c.tokens = newValue
+			if c.tokens > c.capacity {
+				c.tokens = c.capacity
+			}
+			c.last = now
+		} else {
+			sleepTime := math.Ceil(float64(int64(plen)-newValue) * c.nsPerToken)
+			//log.Println(sleepTime, c.tokens)
+			time.Sleep(time.Duration(sleepTime))
+			c.metrics.throttleWait.add(uint64(sleepTime))
+		}
+	}
+}
+
 /*
  * file transfer start packet
  *
  * type - uint8 - 0x02
- * filetype - uint8 - 0x00 (regular file)
+ * filetype - uint8 - file type (low nibble, 0x00 regular file) | content encoding (high nibble, 0x00 none, 0x10 gzip)
+ * manifestSessionId - uint32 - manifest session id
+ * fileIndex - uint32 - file index in the manifest
+ * size - uint64 - size of file in bytes, after content encoding
+ * mtime - int64 - unix seconds
+ * fecData - uint8 - data packets per FEC block
+ * fecParity - uint8 - repair packets per FEC block, 0 if FEC is disabled
+ * chunkSize - uint32 - payload size of every data packet but the last
+ * macSize - uint8 - size of the MAC in data and repair packets, 0 if disabled
+ * sign - byte[] - hmac512 or ed25519 signature of this packet
+ *
+ *
+ *
+ * file transfer data packet
+ *
+ * type - uint8 - 0x80
+ * manifestSessionId - uint32 - manifest session id
+ * fileIndex - uint32 - file index in the manifest
+ * offset - uint64 - byte offset of the payload in the file
+ * payload - byte[] - encoded file content, chunkSize bytes for all but the last packet
+ * mac - byte[macSize] - truncated hmac-sha256 of this packet, see sign.go
+ *
+ *
+ *
+ * file transfer repair packet
+ *
+ * type - uint8 - 0x04
  * manifestSessionId - uint32 - manifest session id
  * fileIndex - uint32 - file index in the manifest
- * size - uint64 - size of file in bytes
- * mtime - int64 - unix millis
- * sign - byte[64] - hmac512 of this packet
+ * block - uint32 - FEC block index
+ * repairIndex - uint8 - index of the repair packet within the block
+ * payload - byte[chunkSize] - reed-solomon repair shard of the block
+ * mac - byte[macSize] - truncated hmac-sha256 of this packet
  *
  *
  *
@@ -103,201 +188,391 @@ func sendManifest(conf *Config, c *net.UDPConn, manifest *Manifest, manifestId u
  * manifestSessionId - uint32 - manifest session id
  * fileIndex - uint32 - file index in the manifest
  * hash - byte[32] - sha256 of file content
- * sign - byte[64] - hmac512 of this packet
+ * sign - byte[] - hmac512 or ed25519 signature of this packet
  */
-func sendFile(conf *Config, c *net.UDPConn, manifestId uint32, fIndex uint32, f string) error {
+func (s *Sender) sendFile(ctx context.Context, c *senderConn, manifestId uint32, sc *sessionCipher, sig signer, fIndex uint32, f string, mf FileRecord, compressed compressedFiles) error {
+	conf := s.conf
 	finfo, err := os.Stat(f)
 	if err != nil {
 		return err
 	}
+	if finfo.Size() != mf.size {
+		// the receiver only accepts the size in the manifest
+		return errors.New("File size changed since the manifest was created")
+	}
+
+	s.log.Info("Sending file", "manifest", hexId(manifestId), "file", fIndex, "path", mf.path, "size", mf.size)
+
+	h := sha256.New()
+	size := finfo.Size()
+	encoding := byte(ENCODING_NONE)
+	src := f
+	cf, err := compressed.get(conf, fIndex, f, size)
+	if err != nil {
+		return err
+	}
+	if cf.name != "" {
+		cinfo, err := os.Stat(cf.name)
+		if err != nil {
+			return err
+		}
+		s.log.Debug("Compressed file", "manifest", hexId(manifestId), "file", fIndex, "path", mf.path, "size", size, "compressed", cinfo.Size())
+		size = cinfo.Size()
+		encoding = ENCODING_GZIP
+		src = cf.name
+	}
 
-	file, err := os.Open(f)
+	file, err := os.Open(src)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	if conf.Verbose {
-		fmt.Println("Sending file " + f)
+	var fec *fecCodec
+	chunkSize := maxPayload(conf) - DATA_HEADER_SIZE
+	overhead := HEADER_OVERHEAD
+	if sc != nil {
+		chunkSize -= CRYPTO_OVERHEAD
+		overhead += CRYPTO_OVERHEAD
+	}
+	var pm *packetMac
+	if conf.DataMACSize > 0 {
+		pm = newPacketMac(conf.HMACSecret, conf.DataMACSize)
+		chunkSize -= pm.size
+	}
+	if conf.FECParity > 0 {
+		fec, err = newFecCodec(conf.FECData, conf.FECParity)
+		if err != nil {
+			return err
+		}
 	}
 
-	buff := make([]byte, conf.MaxPacketSize)
+	buff := make([]byte, maxPayload(conf))
 	buff[0] = 0x02
-	buff[1] = 0x00
+	buff[1] = FILE_TYPE_REGULAR | encoding
 	binary.BigEndian.PutUint32(buff[2:], manifestId)
 	binary.BigEndian.PutUint32(buff[6:], fIndex)
-	binary.BigEndian.PutUint64(buff[10:], uint64(finfo.Size()))
+	binary.BigEndian.PutUint64(buff[10:], uint64(size))
 	binary.BigEndian.PutUint64(buff[18:], uint64(finfo.ModTime().Unix()))
-	h512 := sha512.New()
-	io.WriteString(h512, conf.HMACSecret)
-	mac := hmac.New(sha512.New, h512.Sum(nil))
-	mac.Write(buff[:26])
-	copy(buff[26:], mac.Sum(nil))
-	c.Write(buff[:26+64])
-
-	h := sha256.New()
+	if fec != nil {
+		buff[26] = byte(fec.k)
+		buff[27] = byte(fec.m)
+	} else {
+		buff[26] = 0
+		buff[27] = 0
+	}
+	binary.BigEndian.PutUint32(buff[28:], uint32(chunkSize))
+	buff[32] = byte(conf.DataMACSize)
+	copy(buff[33:], sig.sign(buff[:33]))
+	writePacket(c, sc, buff[:33+sig.size()], 6)
 
 	time.Sleep(50 * time.Millisecond)
 
-	//buffOut := make([]byte, MAX_PACKET_SIZE)
-	buff[0] = 0x7F
-	//	pos := 0
+	var shards [][]byte
+	var repair []byte
+	if fec != nil {
+		shards = make([][]byte, fec.k)
+		for i := range shards {
+			shards[i] = make([]byte, chunkSize)
+		}
+		repair = make([]byte, REPAIR_HEADER_SIZE+chunkSize+conf.DataMACSize)
+		repair[0] = 0x04
+		binary.BigEndian.PutUint32(repair[1:], manifestId)
+		binary.BigEndian.PutUint32(repair[5:], fIndex)
+	}
+	block := 0
+	blockPackets := 0
+
+	sendRepair := func() {
+		for i := blockPackets; i < fec.k; i++ {
+			for x := range shards[i] {
+				shards[i][x] = 0
+			}
+		}
+		binary.BigEndian.PutUint32(repair[9:], uint32(block))
+		for j := 0; j < fec.m; j++ {
+			repair[13] = byte(j)
+			fec.encode(shards, j, repair[REPAIR_HEADER_SIZE:REPAIR_HEADER_SIZE+chunkSize])
+			if pm != nil {
+				copy(repair[REPAIR_HEADER_SIZE+chunkSize:], pm.sum(repair[:REPAIR_HEADER_SIZE+chunkSize]))
+			}
+			c.throttle(len(repair) + overhead)
+			writePacket(c, sc, repair, 5)
+		}
+		block++
+		blockPackets = 0
+	}
+
+	buff[0] = 0x80
+	binary.BigEndian.PutUint32(buff[1:], manifestId)
+	binary.BigEndian.PutUint32(buff[5:], fIndex)
+	offset := uint64(0)
 	for {
-		read, err := file.Read(buff[1:])
-		//		fmt.Println("read=%d", read, err)
-		if read == 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		read, err := io.ReadFull(file, buff[DATA_HEADER_SIZE:DATA_HEADER_SIZE+chunkSize])
+		if read == 0 && err == io.EOF {
 			break
 		}
-		if err != nil {
+		if err != nil && err != io.ErrUnexpectedEOF {
 			return errors.New("Failed to read file: " + err.Error())
 		}
-		//		fmt.Println("xread=%d", read, err)
-		buff[0]++
-		if buff[0] == 0 {
-			buff[0] = 0x80
+		binary.BigEndian.PutUint64(buff[9:], offset)
+		offset += uint64(read)
+		data := buff[DATA_HEADER_SIZE:(DATA_HEADER_SIZE + read)]
+
+		l := DATA_HEADER_SIZE + read
+		if pm != nil {
+			copy(buff[l:], pm.sum(buff[:l]))
+			l += pm.size
+		}
+		c.throttle(l + overhead)
+		writePacket(c, sc, buff[:l], 5)
+		if encoding == ENCODING_NONE {
+			h.Write(data)
 		}
 
-		//		c.WriteMsgUDP(buff[:(read+1)], nil, maddr)
-		if THROTTLE.enabled {
-			plen := read + 1 + HEADER_OVERHEAD
-			for {
-				if THROTTLE.tokens >= int64(plen) {
-					THROTTLE.tokens -= int64(plen)
-					break
-				}
-				now := time.Now()
-				ns := time.Duration.Nanoseconds(now.Sub(THROTTLE.last))
-				//log.Println(ns, ns/THROTTLE.nsPerToken, THROTTLE.tokens)
-				newValue := THROTTLE.tokens + int64(math.Round(float64(ns)/THROTTLE.nsPerToken))
-				if newValue >= int64(plen) {
-					THROTTLE.tokens = newValue
-					if THROTTLE.tokens > THROTTLE.capacity {
-						THROTTLE.tokens = THROTTLE.capacity
-					}
-					THROTTLE.last = now
-				} else {
-					sleepTime := math.Ceil(float64(int64(plen)-newValue) * THROTTLE.nsPerToken)
-					//log.Println(sleepTime, THROTTLE.tokens)
-					time.Sleep(time.Duration(sleepTime))
-				}
+		if fec != nil {
+			shard := shards[blockPackets]
+			for x := copy(shard, data); x < len(shard); x++ {
+				shard[x] = 0
+			}
+			blockPackets++
+			if blockPackets == fec.k {
+				sendRepair()
 			}
 		}
-		c.Write(buff[:(read + 1)])
-		h.Write(buff[1:(read + 1)])
+	}
+	if fec != nil && blockPackets > 0 {
+		sendRepair()
 	}
 
 	hs := h.Sum(nil)
+	if encoding != ENCODING_NONE {
+		hs = cf.hash
+	}
 
 	buff[0] = 0x03
 	binary.BigEndian.PutUint32(buff[1:], manifestId)
 	binary.BigEndian.PutUint32(buff[5:], fIndex)
 	copy(buff[9:], hs)
-	h512 = sha512.New()
-	io.WriteString(h512, conf.HMACSecret)
-	mac = hmac.New(sha512.New, h512.Sum(nil))
-	mac.Write(buff[:9+32])
-	copy(buff[9+32:], mac.Sum(nil))
-	c.Write(buff[:9+32+64])
+	copy(buff[9+32:], sig.sign(buff[:9+32]))
+	writePacket(c, sc, buff[:9+32+sig.size()], 5)
 
-	if conf.Verbose {
-		fmt.Println("Sent file " + f + ", checksum=" + hex.EncodeToString(hs))
-	}
+	s.log.Info("Sent file", "manifest", hexId(manifestId), "file", fIndex, "path", mf.path, "checksum", hex.EncodeToString(hs))
 
 	time.Sleep(100 * time.Millisecond)
 
 	return nil
 }
 
-func send(conf *Config, dir string) error {
-
-	dir = path.Clean(dir)
-
-	manifest, err := generateManifest(dir)
-	if err != nil {
-		return err
+func (s *Sender) dial() (*senderConn, error) {
+	conf := s.conf
+	if err := checkCompression(conf.Sender.Compression); err != nil {
+		return nil, err
 	}
-
-	if len(manifest.files) == 0 && len(manifest.dirs) == 0 {
-		return errors.New("No files to send")
+	if maxPayload(conf) <= DATA_HEADER_SIZE+CRYPTO_OVERHEAD+conf.DataMACSize {
+		return nil, errors.New("Too small packet max size for sending files")
 	}
-
-	maddr, err := net.ResolveUDPAddr("udp", conf.MulticastAddr)
+	if conf.FECParity > 0 {
+		_, err := newFecCodec(conf.FECData, conf.FECParity)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := checkPacketMacSize(conf.DataMACSize)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	var baddr *net.UDPAddr = nil
-	if conf.BindAddr != "" {
-		baddr, err = net.ResolveUDPAddr("udp", conf.BindAddr)
+	if conf.DataMACSize > 0 {
+		err = checkMacSecret(conf, "data MACs")
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
-	c, err := net.DialUDP("udp", baddr, maddr)
+
+	t, err := s.transport()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer c.Close()
+	c := &senderConn{Transport: t, log: s.log, metrics: s.metrics}
+
+	if conf.Sender.Bw > 0 {
+		c.enabled = true
+		bytesPerSecond := int64(1000000 * conf.Sender.Bw / 8)
+		c.nsPerToken = float64(1000000000) / float64(bytesPerSecond)
+		c.capacity = 13 * int64(conf.MaxPacketSize+HEADER_OVERHEAD)
+		c.tokens = c.capacity
+		c.last = time.Now()
+	}
+
+	//	log.Println(c.nsPerToken, c.capacity, c.tokens, c.last)
+	return c, nil
+}
+
+// senderId returns the configured sender id, defaulting to the hostname
+func (s *Sender) senderId() (string, error) {
+	if s.conf.Sender.ID != "" {
+		return s.conf.Sender.ID, nil
+	}
+	return os.Hostname()
+}
+
+// sendSession transmits the manifest and the given file indexes of it in a
+// new manifest session, returning the indexes of the files sent without
+// failure in the last round
+func (s *Sender) sendSession(ctx context.Context, c *senderConn, sig signer, dir string, manifest *Manifest, files []int) ([]int, error) {
+	conf := s.conf
+	var err error
+	manifest.senderId, err = s.senderId()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = c.SetWriteBuffer(10 * conf.MaxPacketSize)
+	manifest.timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+	manifest.sequence, err = nextSequence(conf.StateFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	manifestId := rand.Uint32()
-	err = sendManifest(conf, c, manifest, manifestId)
-	if err != nil {
-		return err
+	// keep FEATURE_RESEND set by SendMissing
+	manifest.features &= FEATURE_RESEND
+	if conf.Sender.Compression != COMPRESSION_NONE {
+		manifest.features |= FEATURE_COMPRESSION
+	}
+	if conf.EncryptionKey != "" {
+		manifest.features |= FEATURE_ENCRYPTION
+	}
+	if conf.FECParity > 0 {
+		manifest.features |= FEATURE_FEC
 	}
 
-	if conf.Sender.Bw > 0 {
-		THROTTLE.enabled = true
-		bytesPerSecond := int64(1000000 * conf.Sender.Bw / 8)
-		THROTTLE.nsPerToken = float64(1000000000) / float64(bytesPerSecond)
-		THROTTLE.capacity = 13 * int64(conf.MaxPacketSize+HEADER_OVERHEAD)
-		THROTTLE.tokens = THROTTLE.capacity
-		THROTTLE.last = time.Now()
+	manifestId := randomId()
+	var sc *sessionCipher
+	if conf.EncryptionKey != "" {
+		sc, err = newSenderCipher(conf.EncryptionKey, manifestId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = sendManifest(conf, c, manifest, manifestId, sc, sig)
+	if err != nil {
+		return nil, err
 	}
 
-	//	log.Println(THROTTLE.nsPerToken, THROTTLE.capacity, THROTTLE.tokens, THROTTLE.last)
+	finfo, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !finfo.IsDir() {
+		files = []int{0}
+	}
 
+	// files are compressed once for all rounds
+	compressed := compressedFiles{}
+	defer compressed.remove()
+	// files failed in their last round, a later round can still succeed
+	failed := map[int]bool{}
 	for rs := 0; rs < conf.ResendCount; rs++ {
 		// wait some to let the receiver create dirs etc
 		time.Sleep(1000 * time.Millisecond)
+		roundStart := c.sent.get()
 
-		finfo, err := os.Stat(dir)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error sending : "+err.Error()+"\n")
-			return err
-		}
+		for _, i := range files {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			f := dir + "/" + manifest.files[i].path
+			if !finfo.IsDir() {
+				f = dir
+			}
+			event := FileEvent{Sender: manifest.senderId, Path: manifest.files[i].path, Size: manifest.files[i].size}
+			err = s.sendFile(ctx, c, manifestId, sc, sig, uint32(i), f, manifest.files[i], compressed)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				s.log.Error("Failed to send file", "manifest", hexId(manifestId), "file", i, "path", manifest.files[i].path, "reason", err)
+				failed[i] = true
+				if s.OnFileFailed != nil {
+					event.Err = err
+					s.OnFileFailed(event)
+				}
+				continue
+			}
+			delete(failed, i)
+			if s.OnFileSent != nil {
+				s.OnFileSent(event)
+			}
 
-		if !finfo.IsDir() {
-			err = sendFile(conf, c, manifestId, 0, dir)
-			return err
-		} else {
-			dir = dir + "/"
-			for i := 0; i < len(manifest.files); i++ {
-				err = sendFile(conf, c, manifestId, uint32(i), dir+manifest.files[i].path)
+			if conf.ResendManifest {
+				err = sendManifest(conf, c, manifest, manifestId, sc, sig)
 				if err != nil {
-					fmt.Fprintf(os.Stderr, "Error sending file: "+manifest.files[i].path+" "+err.Error()+"\n")
-					continue
+					return nil, errors.New("Failed to send manifest: " + err.Error())
 				}
 
-				if conf.ResendManifest {
-					err = sendManifest(conf, c, manifest, manifestId)
-					if err != nil {
-						fmt.Fprintf(os.Stderr, "Error sending manifest: "+err.Error()+"\n")
-						return err
-					}
-
-				}
 			}
 		}
+		s.metrics.roundSent(rs+1, c.sent.get()-roundStart)
+
+		s.log.Info("All files sent", "manifest", hexId(manifestId), "round", rs+1, "rounds", conf.ResendCount)
+	}
 
-		if conf.Verbose {
-			fmt.Printf("All files sent. Transmission %d of %d \n", rs+1, conf.ResendCount)
+	sent := make([]int, 0, len(files))
+	for _, i := range files {
+		if !failed[i] {
+			sent = append(sent, i)
 		}
 	}
-	return nil
+	if !finfo.IsDir() {
+		spoolFile(conf, s.log, path.Dir(dir), finfo.Name(), manifest.files[0], failed[0])
+		return sent, nil
+	}
+	for _, i := range files {
+		spoolFile(conf, s.log, dir, manifest.files[i].path, manifest.files[i], failed[i])
+	}
+	return sent, nil
+}
+
+// Send transmits the file or directory tree at dir, in as many rounds as
+// configured by the resend count
+func (s *Sender) Send(ctx context.Context, dir string) error {
+	dir = path.Clean(dir)
+
+	manifest, err := generateManifest(dir)
+	if err != nil {
+		return err
+	}
+
+	if len(manifest.files) == 0 && len(manifest.dirs) == 0 {
+		return errors.New("No files to send")
+	}
+	return s.send(ctx, dir, manifest)
+}
+
+// send transmits all files of the manifest of dir in a new session
+func (s *Sender) send(ctx context.Context, dir string, manifest *Manifest) error {
+	conf := s.conf
+	err := checkSpoolConfig(conf, dir)
+	if err != nil {
+		return err
+	}
+
+	sig, err := newSigner(conf)
+	if err != nil {
+		return err
+	}
+
+	c, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	files := make([]int, len(manifest.files))
+	for i := range files {
+		files[i] = i
+	}
+	_, err = s.sendSession(ctx, c, sig, dir, manifest, files)
+	return err
 }
@@ -0,0 +1,262 @@
+package godiode
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	SIGNATURE_HMAC    = "hmac"
+	SIGNATURE_ED25519 = "ed25519"
+)
+
+const KEY_ID_SIZE = 8
+
+/**
+ * Signatures
+ *
+ * Manifests and file transfer start/complete packets are signed in one of
+ * two modes.
+ *
+ * hmac
+ * sign - byte[64] - hmac512 keyed with sha512 of the shared secret
+ *
+ * ed25519
+ * keyId - byte[8] - first 8 bytes of sha256 of the signing public key
+ * sign - byte[64] - ed25519 signature
+ */
+
+type signer interface {
+	size() int
+	sign(data []byte) []byte
+}
+
+type verifier interface {
+	size() int
+	verify(data []byte, sign []byte) error
+}
+
+type hmacSigner struct {
+	key []byte
+}
+
+func newHmacSigner(secret string) *hmacSigner {
+	h512 := sha512.New()
+	io.WriteString(h512, secret)
+	return &hmacSigner{h512.Sum(nil)}
+}
+
+func (s *hmacSigner) size() int {
+	return 64
+}
+
+func (s *hmacSigner) sign(data []byte) []byte {
+	mac := hmac.New(sha512.New, s.key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func (s *hmacSigner) verify(data []byte, sign []byte) error {
+	if !hmac.Equal(s.sign(data), sign) {
+		return errors.New("HMAC mismatch")
+	}
+	return nil
+}
+
+type ed25519Signer struct {
+	keyId []byte
+	key   ed25519.PrivateKey
+}
+
+func (s *ed25519Signer) size() int {
+	return KEY_ID_SIZE + ed25519.SignatureSize
+}
+
+func (s *ed25519Signer) sign(data []byte) []byte {
+	return append(append([]byte{}, s.keyId...), ed25519.Sign(s.key, data)...)
+}
+
+type trustedKey struct {
+	name string
+	key  ed25519.PublicKey
+}
+
+type ed25519Verifier struct {
+	keys map[string]trustedKey
+}
+
+func (v *ed25519Verifier) size() int {
+	return KEY_ID_SIZE + ed25519.SignatureSize
+}
+
+func (v *ed25519Verifier) verify(data []byte, sign []byte) error {
+	keyId := hex.EncodeToString(sign[:KEY_ID_SIZE])
+	tk, exists := v.keys[keyId]
+	if !exists {
+		return errors.New("Unknown signing key " + keyId)
+	}
+	if !ed25519.Verify(tk.key, data, sign[KEY_ID_SIZE:]) {
+		return errors.New("Signature verification failed for key " + keyId + " (" + tk.name + ")")
+	}
+	return nil
+}
+
+/*
+ * Data packet MAC
+ *
+ * File data and repair packets can carry a truncated hmac-sha256 of the
+ * packet, keyed with the shared secret, so forged data is rejected before it
+ * is written. Streams and relays are always MACed the same way. The secret
+ * is required for them in ed25519 signature mode too.
+ */
+type packetMac struct {
+	key  []byte
+	hash func() hash.Hash
+	size int
+}
+
+func newPacketMac(secret string, size int) *packetMac {
+	h := sha256.New()
+	io.WriteString(h, "godiode-data-mac")
+	io.WriteString(h, secret)
+	return &packetMac{h.Sum(nil), sha256.New, size}
+}
+
+// newSignerMac creates a truncated hmac-sha512 keyed like the HMAC signer
+func newSignerMac(secret string, size int) *packetMac {
+	return &packetMac{newHmacSigner(secret).key, sha512.New, size}
+}
+
+func checkPacketMacSize(size int) error {
+	if size != 0 && (size < 8 || size > sha256.Size) {
+		return errors.New("Data MAC size must be 0 or between 8 and 32 bytes")
+	}
+	return nil
+}
+
+// checkMacSecret fails without a HMAC secret to key packet MACs with, as the
+// secret is optional in ed25519 signature mode
+func checkMacSecret(conf *Config, what string) error {
+	if conf.HMACSecret == "" {
+		return errors.New("HMAC secret required for " + what)
+	}
+	return nil
+}
+
+func (m *packetMac) sum(data []byte) []byte {
+	mac := hmac.New(m.hash, m.key)
+	mac.Write(data)
+	return mac.Sum(nil)[:m.size]
+}
+
+func (m *packetMac) verify(data []byte, sum []byte) bool {
+	return hmac.Equal(m.sum(data), sum)
+}
+
+func ed25519KeyId(key ed25519.PublicKey) []byte {
+	h := sha256.Sum256(key)
+	return h[:KEY_ID_SIZE]
+}
+
+func newSigner(conf *Config) (signer, error) {
+	switch conf.SignatureMode {
+	case "", SIGNATURE_HMAC:
+		return newHmacSigner(conf.HMACSecret), nil
+	case SIGNATURE_ED25519:
+		data, err := ioutil.ReadFile(conf.Sender.SigningKey)
+		if err != nil {
+			return nil, errors.New("Failed to read signing key: " + err.Error())
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("No PEM data in signing key " + conf.Sender.SigningKey)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.New("Failed to parse signing key: " + err.Error())
+		}
+		priv, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("Signing key is not an ed25519 key")
+		}
+		return &ed25519Signer{ed25519KeyId(priv.Public().(ed25519.PublicKey)), priv}, nil
+	}
+	return nil, errors.New("Invalid signature mode " + conf.SignatureMode)
+}
+
+// countingVerifier counts failed verifications in its metrics
+type countingVerifier struct {
+	verifier
+	metrics *Metrics
+}
+
+func (v countingVerifier) verify(data []byte, sign []byte) error {
+	err := v.verifier.verify(data, sign)
+	if err != nil {
+		v.metrics.authFailed(AUTH_SIGNATURE)
+	}
+	return err
+}
+
+// newVerifier creates the verifier of the signature mode, counting failures
+// in m
+func newVerifier(conf *Config, m *Metrics) (verifier, error) {
+	switch conf.SignatureMode {
+	case "", SIGNATURE_HMAC:
+		return countingVerifier{newHmacSigner(conf.HMACSecret), m}, nil
+	case SIGNATURE_ED25519:
+		v, err := loadTrustStore(conf.Receiver.TrustStore)
+		if err != nil {
+			return nil, err
+		}
+		return countingVerifier{v, m}, nil
+	}
+	return nil, errors.New("Invalid signature mode " + conf.SignatureMode)
+}
+
+// loadTrustStore reads all PEM encoded ed25519 public keys in dir
+func loadTrustStore(dir string) (*ed25519Verifier, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.New("Failed to read trust store: " + err.Error())
+	}
+	v := &ed25519Verifier{map[string]trustedKey{}}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".pem") {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, errors.New("Failed to read trusted key " + e.Name() + ": " + err.Error())
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("No PEM data in trusted key " + e.Name())
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, errors.New("Failed to parse trusted key " + e.Name() + ": " + err.Error())
+		}
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("Trusted key " + e.Name() + " is not an ed25519 key")
+		}
+		v.keys[hex.EncodeToString(ed25519KeyId(pub))] = trustedKey{e.Name(), pub}
+	}
+	if len(v.keys) == 0 {
+		return nil, errors.New("No trusted keys in " + dir)
+	}
+	return v, nil
+}
@@ -0,0 +1,134 @@
+package godiode
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// writeKeyPair writes a generated ed25519 signing key to dir/name.key and
+// its public key to trust/name.pem
+func writeKeyPair(t *testing.T, dir string, trust string, name string) string {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privDer, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := path.Join(dir, name+".key")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if trust != "" {
+		pubDer, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path.Join(trust, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDer}), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return keyFile
+}
+
+func ed25519Config(t *testing.T, key string, trust string) *Config {
+	conf := testConfig(t)
+	conf.SignatureMode = SIGNATURE_ED25519
+	conf.Sender.SigningKey = key
+	conf.Receiver.TrustStore = trust
+	return conf
+}
+
+func TestSendReceiveEd25519(t *testing.T) {
+	trust := t.TempDir()
+	key := writeKeyPair(t, t.TempDir(), trust, "sender")
+	writeKeyPair(t, t.TempDir(), trust, "other")
+	testTransfer(t, ed25519Config(t, key, trust), Impairment{})
+}
+
+func TestUnknownSigningKeyRejected(t *testing.T) {
+	trust := t.TempDir()
+	writeKeyPair(t, t.TempDir(), trust, "trusted")
+	key := writeKeyPair(t, t.TempDir(), "", "untrusted")
+	rconf := ed25519Config(t, "", trust)
+	rconf.Metrics = NewMetrics()
+	assertNothingReceived(t, ed25519Config(t, key, ""), rconf)
+	if rconf.Metrics.authFailures[AUTH_SIGNATURE].get() == 0 {
+		t.Error("no signature failures counted")
+	}
+}
+
+func TestEd25519BadSignature(t *testing.T) {
+	trust := t.TempDir()
+	key := writeKeyPair(t, t.TempDir(), trust, "sender")
+	s, err := newSigner(ed25519Config(t, key, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := loadTrustStore(trust)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("manifest")
+	sign := s.sign(data)
+	if err := v.verify(data, sign); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.verify([]byte("tampered"), sign); err == nil {
+		t.Error("tampered data verified")
+	}
+	sign[len(sign)-1] ^= 1
+	err = v.verify(data, sign)
+	if err == nil || !strings.Contains(err.Error(), "sender.pem") {
+		t.Errorf("expected a verification failure for the known key, got %v", err)
+	}
+}
+
+func TestLoadTrustStoreMalformed(t *testing.T) {
+	trust := t.TempDir()
+	writeKeyPair(t, t.TempDir(), trust, "good")
+	if _, err := loadTrustStore(trust); err != nil {
+		t.Fatal(err)
+	}
+
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDer, err := x509.MarshalPKIXPublicKey(&ec.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{
+		"not pem":     []byte("garbage"),
+		"bad der":     pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte{1, 2, 3}}),
+		"not ed25519": pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: ecDer}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeKeyPair(t, t.TempDir(), dir, "good")
+			if err := os.WriteFile(path.Join(dir, "bad.pem"), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadTrustStore(dir); err == nil || !strings.Contains(err.Error(), "bad.pem") {
+				t.Errorf("expected an error for bad.pem, got %v", err)
+			}
+		})
+	}
+
+	if _, err := loadTrustStore(t.TempDir()); err == nil {
+		t.Error("empty trust store loaded")
+	}
+	if _, err := loadTrustStore(path.Join(trust, "missing")); err == nil {
+		t.Error("missing trust store loaded")
+	}
+}
@@ -0,0 +1,126 @@
+package godiode
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	AFTER_SEND_KEEP   = "keep"
+	AFTER_SEND_MOVE   = "move"
+	AFTER_SEND_DELETE = "delete"
+)
+
+func checkSpoolConfig(conf *Config, dir string) error {
+	switch conf.Sender.AfterSend {
+	case "", AFTER_SEND_KEEP, AFTER_SEND_DELETE:
+	case AFTER_SEND_MOVE:
+		if conf.Sender.SentDir == "" {
+			return errors.New("Sent dir required when moving sent files")
+		}
+	default:
+		return errors.New("Invalid after send action " + conf.Sender.AfterSend)
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	for _, d := range []string{conf.Sender.SentDir, conf.Sender.FailedDir} {
+		if d == "" {
+			continue
+		}
+		absD, err := filepath.Abs(d)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(absDir, absD)
+		if err != nil {
+			return err
+		}
+		if rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))) {
+			return errors.New("Spool dir " + d + " must be outside of " + dir)
+		}
+	}
+	return nil
+}
+
+// spoolFile moves or deletes a file in dir once all rounds are done,
+// according to the sender after send action. Files changed since mf was sent
+// are left in place.
+func spoolFile(conf *Config, log *Logger, dir string, rel string, mf FileRecord, failed bool) {
+	src := path.Join(dir, rel)
+	// moved to dst, or deleted without one
+	dst := ""
+	if failed {
+		if conf.Sender.FailedDir == "" {
+			return
+		}
+		dst = path.Join(conf.Sender.FailedDir, rel)
+	} else if conf.Sender.AfterSend == AFTER_SEND_MOVE {
+		dst = path.Join(conf.Sender.SentDir, rel)
+	} else if conf.Sender.AfterSend != AFTER_SEND_DELETE {
+		return
+	}
+	finfo, err := os.Stat(src)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err == nil && (finfo.Size() != mf.size || finfo.ModTime().Unix() != int64(mf.modts)) {
+		log.Warn("File changed since it was sent, leaving it in place", "path", src)
+		return
+	}
+	if dst != "" {
+		err = moveFile(src, dst)
+	} else {
+		err = os.Remove(src)
+	}
+	if err != nil {
+		log.Error("Failed to spool file", "path", src, "err", err)
+	} else {
+		log.Info("Spooled file", "path", src)
+	}
+}
+
+func moveFile(src string, dst string) error {
+	err := os.MkdirAll(path.Dir(dst), 0700)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+
+	// fallback to copy+rm, dst may be located on another fs
+	finfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, finfo.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	err = out.Close()
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	os.Chtimes(dst, finfo.ModTime(), finfo.ModTime())
+	return os.Remove(src)
+}
@@ -0,0 +1,96 @@
+package godiode
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckSpoolConfig(t *testing.T) {
+	dir := t.TempDir()
+	for d, valid := range map[string]bool{
+		filepath.Join(dir, "sent"):            false,
+		dir:                                   false,
+		filepath.Join(dir, "..sent"):          false,
+		filepath.Join(dir, "..", "sent"):      true,
+		filepath.Join(dir, "..", "..", "out"): true,
+	} {
+		conf := DefaultConfig()
+		conf.Sender.AfterSend = AFTER_SEND_MOVE
+		conf.Sender.SentDir = d
+		err := checkSpoolConfig(&conf, dir)
+		if valid && err != nil {
+			t.Errorf("rejected %s: %v", d, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("accepted %s", d)
+		}
+	}
+}
+
+func TestSpoolChangedFile(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Logger = &Logger{out: ioutil.Discard}
+	conf.Sender.AfterSend = AFTER_SEND_DELETE
+	dir := t.TempDir()
+	writeTree(t, dir, map[string][]byte{"a.txt": []byte("a\n"), "b.txt": []byte("b\n")})
+	mf := FileRecord{DirRecord{"a.txt", uint32(testMtime.Unix())}, 2}
+
+	// touched after it was sent
+	os.Chtimes(filepath.Join(dir, "b.txt"), time.Now(), testMtime.Add(time.Second))
+	spoolFile(&conf, conf.Logger, dir, "b.txt", FileRecord{DirRecord{"b.txt", uint32(testMtime.Unix())}, 2}, false)
+	if _, err := os.Stat(filepath.Join(dir, "b.txt")); err != nil {
+		t.Error("deleted changed file")
+	}
+	spoolFile(&conf, conf.Logger, dir, "a.txt", mf, false)
+	if _, err := os.Stat(filepath.Join(dir, "a.txt")); err == nil {
+		t.Error("kept unchanged file")
+	}
+}
+
+func TestSpoolFailedOnlyInEarlyRound(t *testing.T) {
+	conf := testConfig(t)
+	conf.ResendCount = 2
+	src := t.TempDir()
+	conf.Sender.AfterSend = AFTER_SEND_MOVE
+	conf.Sender.SentDir = t.TempDir()
+	conf.Sender.FailedDir = t.TempDir()
+	writeTree(t, src, map[string][]byte{"a.txt": []byte("a\n"), "b.txt": []byte("b\n")})
+	b := filepath.Join(src, "b.txt")
+	hidden := filepath.Join(t.TempDir(), "b.txt")
+
+	n := NewMemoryNetwork(Impairment{})
+	startReceiver(t, conf, n.Listen(), t.TempDir())
+	s, err := NewSender(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Transport = n.Dial()
+	// b.txt fails in the first round only
+	failed := false
+	s.OnFileSent = func(e FileEvent) {
+		if e.Path == "a.txt" && !failed {
+			os.Rename(b, hidden)
+		}
+	}
+	s.OnFileFailed = func(e FileEvent) {
+		failed = true
+		os.Rename(hidden, b)
+	}
+	err = s.Send(context.Background(), src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !failed {
+		t.Fatal("b.txt did not fail")
+	}
+	if _, err := os.Stat(filepath.Join(conf.Sender.SentDir, "b.txt")); err != nil {
+		t.Error("b.txt not moved to the sent dir")
+	}
+	if _, err := os.Stat(filepath.Join(conf.Sender.FailedDir, "b.txt")); err == nil {
+		t.Error("b.txt moved to the failed dir")
+	}
+}
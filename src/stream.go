@@ -0,0 +1,608 @@
+package godiode
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const STREAM_HEADER_SIZE = 1 + 4 + 8 + 8 + 1
+
+const STREAM_MAC_SIZE = 16
+
+const STREAM_FLAG_EOF = 0x01
+
+// the end of stream packet is repeated to survive packet loss
+const STREAM_EOF_REPEAT = 3
+
+// max stream ciphers kept by a receiver, the least recently used is dropped
+const MAX_STREAM_CIPHERS = 256
+
+/**
+ * Streams
+ *
+ * A stream is an unbounded sequence of bytes sent in sequenced packets. There
+ * are no retransmissions, lost packets are reported as gaps by the receiver.
+ *
+ * stream data packet
+ *
+ * type - uint8 - 0x05
+ * streamId - uint32 - random id of the stream
+ * seq - uint64 - packet sequence number within the stream, starting at 0
+ * timestamp - int64 - sender clock when the packet was sent (unix millis)
+ * flags - uint8 - 0x01 end of stream
+ * payload - byte[] - stream data
+ * mac - byte[16] - truncated hmac-sha256 of this packet, keyed like file data MACs
+ *
+ * encrypted stream data packet
+ *
+ * | type | streamId | salt | seq | sealed rest of the packet | tag |
+ * salt - byte[16] - random stream salt, the stream key is derived from the
+ *                   pre-shared key, the stream id and the salt
+ *
+ * Idle streams send an empty packet every third of the stream timeout. The
+ * receiver ends a stream without packets for the stream timeout, so a lost
+ * end of stream does not block it forever.
+ *
+ * Packets with a timestamp off by more than the max clock skew are rejected,
+ * and so are new streams with the id of a stream already received, see
+ * replay.go.
+ */
+
+type streamWriter struct {
+	conf   *Config
+	c      *senderConn
+	sc     *sessionCipher
+	mac    *packetMac
+	id     uint32
+	seq    uint64
+	buff   []byte
+	sealed []byte
+}
+
+func newStreamWriter(conf *Config, c *senderConn) (*streamWriter, error) {
+	w := &streamWriter{
+		conf: conf,
+		c:    c,
+		mac:  newPacketMac(conf.HMACSecret, STREAM_MAC_SIZE),
+		id:   randomId(),
+		buff: make([]byte, maxPayload(conf)),
+	}
+	if conf.EncryptionKey != "" {
+		sc, err := newSenderCipher(conf.EncryptionKey, w.id)
+		if err != nil {
+			return nil, err
+		}
+		w.sc = sc
+	}
+	if w.chunkSize() < 1 {
+		return nil, errors.New("Too small packet max size for streams")
+	}
+	w.buff[0] = 0x05
+	binary.BigEndian.PutUint32(w.buff[1:], w.id)
+	return w, nil
+}
+
+// chunkSize is the max payload of a stream packet
+func (w *streamWriter) chunkSize() int {
+	size := maxPayload(w.conf) - STREAM_HEADER_SIZE - STREAM_MAC_SIZE
+	if w.sc != nil {
+		size -= SALT_SIZE + CRYPTO_OVERHEAD
+	}
+	return size
+}
+
+// send writes a single stream packet, data must fit in one chunk
+func (w *streamWriter) send(data []byte, flags byte) error {
+	binary.BigEndian.PutUint64(w.buff[5:], w.seq)
+	binary.BigEndian.PutUint64(w.buff[13:], uint64(time.Now().UnixNano()/int64(time.Millisecond)))
+	w.buff[21] = flags
+	l := STREAM_HEADER_SIZE + copy(w.buff[STREAM_HEADER_SIZE:], data)
+	copy(w.buff[l:], w.mac.sum(w.buff[:l]))
+	l += STREAM_MAC_SIZE
+	pkt := w.buff[:l]
+	if w.sc != nil {
+		w.sealed = sealSalted(w.sc, w.sealed, pkt)
+		pkt = w.sealed
+	}
+	w.c.throttle(len(pkt) + HEADER_OVERHEAD)
+	return w.c.WritePacket(pkt)
+}
+
+// sealSalted encrypts a stream or relay packet into dst, with the salt sent
+// along in every packet as there is no manifest to carry it
+func sealSalted(sc *sessionCipher, dst []byte, pkt []byte) []byte {
+	sc.buff = sc.seal(sc.buff, pkt, 5)
+	return append(append(append(dst[:0], sc.buff[:5]...), sc.salt...), sc.buff[5:]...)
+}
+
+// Write sends p in as many packets as needed
+func (w *streamWriter) Write(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		l := len(p) - n
+		if l > w.chunkSize() {
+			l = w.chunkSize()
+		}
+		err := w.send(p[n:n+l], 0)
+		if err != nil {
+			return n, err
+		}
+		w.seq++
+		n += l
+	}
+	return n, nil
+}
+
+// keepalive sends an empty packet to keep an idle stream open
+func (w *streamWriter) keepalive() error {
+	err := w.send(nil, 0)
+	w.seq++
+	return err
+}
+
+// Close signals the end of the stream
+func (w *streamWriter) Close() error {
+	// give reordered packets a chance to arrive before the end of stream
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < STREAM_EOF_REPEAT; i++ {
+		err := w.send(nil, STREAM_FLAG_EOF)
+		if err != nil {
+			return err
+		}
+	}
+	w.seq++
+	return nil
+}
+
+type streamChunk struct {
+	data []byte
+	err  error
+}
+
+// SendStream sends everything read from in as a stream, until EOF. Cancelling
+// ctx returns right away, leaving a blocked read of in behind.
+func (s *Sender) SendStream(ctx context.Context, in io.Reader) error {
+	conf := s.conf
+	if conf.StreamTimeout < 1 {
+		return errors.New("Invalid stream timeout")
+	}
+	if err := checkMacSecret(conf, "streams"); err != nil {
+		return err
+	}
+	c, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	stopHeartbeats, err := s.startHeartbeats(c, func() uint64 { return 0 })
+	if err != nil {
+		return err
+	}
+	defer stopHeartbeats()
+
+	w, err := newStreamWriter(conf, c)
+	if err != nil {
+		return err
+	}
+	s.log.Info("Sending stream", "stream", hexId(w.id))
+	// in is read by its own goroutine, so keepalives are sent while a read
+	// blocks
+	chunks := make(chan streamChunk)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			buff := make([]byte, w.chunkSize())
+			read, err := in.Read(buff)
+			select {
+			case chunks <- streamChunk{buff[:read], err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	keepalive := time.Duration(conf.StreamTimeout) * time.Second / 3
+	t := time.NewTicker(keepalive)
+	defer t.Stop()
+	lastSent := time.Now()
+	sent := uint64(0)
+	for {
+		var chunk streamChunk
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			if time.Since(lastSent) >= keepalive {
+				err = w.keepalive()
+				if err != nil {
+					return errors.New("Failed to send stream: " + err.Error())
+				}
+				lastSent = time.Now()
+			}
+			continue
+		case chunk = <-chunks:
+		}
+		// every read is sent right away to keep latency low for slow feeds
+		if len(chunk.data) > 0 {
+			_, err = w.Write(chunk.data)
+			if err != nil {
+				return errors.New("Failed to send stream: " + err.Error())
+			}
+			sent += uint64(len(chunk.data))
+			lastSent = time.Now()
+		}
+		if chunk.err == io.EOF {
+			break
+		}
+		if chunk.err != nil {
+			return errors.New("Failed to read stream: " + chunk.err.Error())
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		return errors.New("Failed to send stream: " + err.Error())
+	}
+	s.log.Info("Sent stream", "stream", hexId(w.id), "size", sent, "packets", w.seq)
+	return nil
+}
+
+type streamPacket struct {
+	id        uint32
+	seq       uint64
+	timestamp int64
+	flags     byte
+	data      []byte
+}
+
+// streamOpener authenticates and, with encryption enabled, decrypts stream
+// and relay packets
+type streamOpener struct {
+	conf    *Config
+	metrics *Metrics
+	mac     *packetMac
+	// relay datagrams are MACed like manifests are signed
+	relayMac *packetMac
+	// ciphers of the streams decrypted, by stream id
+	ciphers map[uint32]*streamCipher
+	plain   []byte
+}
+
+type streamCipher struct {
+	sc       *sessionCipher
+	lastSeen time.Time
+}
+
+func newStreamOpener(conf *Config, m *Metrics) *streamOpener {
+	return &streamOpener{
+		conf:     conf,
+		metrics:  m,
+		mac:      newPacketMac(conf.HMACSecret, STREAM_MAC_SIZE),
+		relayMac: newSignerMac(conf.HMACSecret, STREAM_MAC_SIZE),
+		ciphers:  map[uint32]*streamCipher{},
+	}
+}
+
+// packetIdFields returns the log fields of the stream or relay id of a packet
+func packetIdFields(pkt []byte) []interface{} {
+	key := "stream"
+	if pkt[0] == 0x06 {
+		key = "relay"
+	}
+	return []interface{}{key, hexId(binary.BigEndian.Uint32(pkt[1:]))}
+}
+
+// authenticate returns the decrypted packet with a valid MAC, with the MAC
+// stripped
+func (o *streamOpener) authenticate(buff []byte, read int) ([]byte, error) {
+	pkt := buff[:read]
+	if o.conf.EncryptionKey != "" {
+		if read < 5+SALT_SIZE {
+			return nil, errors.New("Received truncated encrypted packet")
+		}
+		id := binary.BigEndian.Uint32(pkt[1:])
+		salt := pkt[5 : 5+SALT_SIZE]
+		cached := o.ciphers[id]
+		var sc *sessionCipher
+		if cached != nil && bytes.Equal(cached.sc.salt, salt) {
+			sc = cached.sc
+		} else {
+			var err error
+			sc, err = newSessionCipher(o.conf.EncryptionKey, id, append([]byte{}, salt...))
+			if err != nil {
+				return nil, err
+			}
+		}
+		sealed := append(append([]byte{}, pkt[:5]...), pkt[5+SALT_SIZE:]...)
+		plain, err := sc.open(o.plain, sealed, 5)
+		if err != nil {
+			o.metrics.authFailed(AUTH_DECRYPTION)
+			return nil, fieldErr("Packet failing decryption: "+err.Error(), packetIdFields(pkt)...)
+		}
+		o.plain = plain
+		// only ciphers of authentic packets are kept
+		if cached == nil || cached.sc != sc {
+			o.addCipher(id, sc)
+		} else {
+			cached.lastSeen = time.Now()
+		}
+		pkt = plain
+	}
+	if len(pkt) < 5+STREAM_MAC_SIZE {
+		return nil, errors.New("Received truncated packet")
+	}
+	l := len(pkt) - STREAM_MAC_SIZE
+	mac := o.mac
+	if pkt[0] == 0x06 {
+		mac = o.relayMac
+	}
+	if !mac.verify(pkt[:l], pkt[l:]) {
+		o.metrics.authFailed(AUTH_MAC)
+		return nil, fieldErr("Packet with invalid MAC", packetIdFields(pkt)...)
+	}
+	return pkt[:l], nil
+}
+
+// addCipher keeps the cipher of a stream, dropping the least recently used
+// one if there are too many
+func (o *streamOpener) addCipher(id uint32, sc *sessionCipher) {
+	if _, exists := o.ciphers[id]; !exists && len(o.ciphers) >= MAX_STREAM_CIPHERS {
+		oldest := id
+		for i, c := range o.ciphers {
+			if oldest == id || c.lastSeen.Before(o.ciphers[oldest].lastSeen) {
+				oldest = i
+			}
+		}
+		delete(o.ciphers, oldest)
+	}
+	o.ciphers[id] = &streamCipher{sc: sc, lastSeen: time.Now()}
+}
+
+func (o *streamOpener) open(buff []byte, read int) (*streamPacket, error) {
+	pkt, err := o.authenticate(buff, read)
+	if err != nil {
+		return nil, err
+	}
+	if len(pkt) < STREAM_HEADER_SIZE {
+		return nil, errors.New("Received truncated stream packet")
+	}
+	p := &streamPacket{
+		id:        binary.BigEndian.Uint32(pkt[1:]),
+		seq:       binary.BigEndian.Uint64(pkt[5:]),
+		timestamp: int64(binary.BigEndian.Uint64(pkt[13:])),
+		flags:     pkt[21],
+		data:      pkt[STREAM_HEADER_SIZE:],
+	}
+	err = checkClockSkew(o.conf, p.timestamp)
+	if err != nil {
+		return nil, withFields(err, "stream", hexId(p.id))
+	}
+	return p, nil
+}
+
+// streamReassembler writes the packets of one stream in order, waiting up to
+// window packets for reordered ones before the missing ones are declared lost.
+// Strict reassemblers fail on loss instead of skipping the gap.
+type streamReassembler struct {
+	id      uint32
+	out     io.Writer
+	strict  bool
+	window  uint64
+	next    uint64
+	pending map[uint64]*streamPacket
+	last    uint64
+	eof     bool
+	lost    uint64
+	gaps    int
+	written uint64
+	log     *Logger
+}
+
+func newStreamReassembler(id uint32, out io.Writer, window int, log *Logger) *streamReassembler {
+	return &streamReassembler{
+		id:      id,
+		out:     out,
+		log:     log,
+		window:  uint64(window),
+		pending: map[uint64]*streamPacket{},
+	}
+}
+
+// joinedLate reports whether the first packet seen of a stream is past the
+// reorder window, so the start of the stream was sent before it was joined
+func joinedLate(seq uint64, window int) bool {
+	return seq > 0 && seq >= uint64(window)
+}
+
+// join starts a stream joined late at seq, the packets before are not lost
+func (s *streamReassembler) join(seq uint64) {
+	s.next = seq
+	s.last = seq
+}
+
+func (s *streamReassembler) push(p *streamPacket) error {
+	if s.eof || p.seq < s.next || s.pending[p.seq] != nil {
+		return nil
+	}
+	p.data = append([]byte{}, p.data...)
+	s.pending[p.seq] = p
+	if p.seq > s.last {
+		s.last = p.seq
+	}
+	for {
+		err := s.flush()
+		if err != nil || s.eof || len(s.pending) == 0 {
+			return err
+		}
+		// the end of stream is sent last, anything still missing is lost
+		if s.last-s.next < s.window && s.pending[s.last].flags&STREAM_FLAG_EOF == 0 {
+			return nil
+		}
+		err = s.skipGap()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// skipGap declares the packets missing before the first pending one lost
+func (s *streamReassembler) skipGap() error {
+	first := s.last
+	for seq := range s.pending {
+		if seq < first {
+			first = seq
+		}
+	}
+	if s.strict {
+		return errors.New("Lost " + strconv.FormatUint(first-s.next, 10) + " packets after " + strconv.FormatUint(s.written, 10) + " bytes")
+	}
+	s.log.Warn("Lost stream packets", "stream", hexId(s.id), "lost", first-s.next, "offset", s.written)
+	s.lost += first - s.next
+	s.gaps++
+	s.next = first
+	return nil
+}
+
+// end writes the pending packets of a stream that timed out, skipping the
+// gaps
+func (s *streamReassembler) end() error {
+	for {
+		err := s.flush()
+		if err != nil || s.eof || len(s.pending) == 0 {
+			return err
+		}
+		err = s.skipGap()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// flush writes the in order packets
+func (s *streamReassembler) flush() error {
+	for {
+		p := s.pending[s.next]
+		if p == nil {
+			return nil
+		}
+		delete(s.pending, s.next)
+		s.next++
+		_, err := s.out.Write(p.data)
+		if err != nil {
+			return err
+		}
+		s.written += uint64(len(p.data))
+		if p.flags&STREAM_FLAG_EOF != 0 {
+			s.eof = true
+			return nil
+		}
+	}
+}
+
+// ReceiveStream writes the first stream received to out, returning at the
+// end of the stream or when nothing was received of it for the stream
+// timeout. Lost packets are reported as an error once the stream has ended.
+// A stream joined after its start is written from the first packet seen.
+func (r *Receiver) ReceiveStream(ctx context.Context, out io.Writer) error {
+	conf := r.conf
+	if conf.StreamTimeout < 1 {
+		return errors.New("Invalid stream timeout")
+	}
+	if err := checkMacSecret(conf, "streams"); err != nil {
+		return err
+	}
+	c, err := r.listen()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	defer interruptOnDone(ctx, c)()
+
+	replay, err := newReplayGuard(conf.StateFile, conf.Receiver.MaxClockSkew)
+	if err != nil {
+		return err
+	}
+	o := newStreamOpener(conf, r.metrics)
+	var s *streamReassembler
+	// streams rejected as replayed, reported once
+	rejected := map[uint32]bool{}
+	packets := newPacketReader(conf, c, r.log, r.metrics)
+	stopHealth, err := r.monitorHealth(packets, nil)
+	if err != nil {
+		return err
+	}
+	defer stopHealth()
+	timeout := time.Duration(conf.StreamTimeout) * time.Second
+	lastSeen := time.Now()
+	for {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		buff, err := packets.read()
+		read := len(buff)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			read = 0
+		} else if err != nil {
+			return errors.New("Failed to recv data: " + err.Error())
+		}
+		if s != nil && time.Since(lastSeen) > timeout {
+			r.log.Warn("Stream timed out", "stream", hexId(s.id))
+			err = s.end()
+			if err != nil {
+				return errors.New("Failed to write stream: " + err.Error())
+			}
+			return errors.New("Stream " + strconv.FormatUint(uint64(s.id), 16) + " timed out after " + strconv.FormatUint(s.written, 10) + " bytes")
+		}
+		if read < 1 || buff[0] != 0x05 {
+			continue
+		}
+		p, err := o.open(buff, read)
+		if err != nil {
+			r.log.warnErr("Rejected stream packet", err)
+			continue
+		}
+		if s == nil {
+			if rejected[p.id] {
+				continue
+			}
+			err = replay.acceptStream(p.id, p.timestamp)
+			if err != nil {
+				r.log.warnErr("Rejected stream", err)
+				rejected[p.id] = true
+				continue
+			}
+			r.log.Info("Receiving stream", "stream", hexId(p.id))
+			s = newStreamReassembler(p.id, out, conf.Receiver.ReorderWindow, r.log)
+			if joinedLate(p.seq, conf.Receiver.ReorderWindow) {
+				r.log.Warn("Joined stream after its start", "stream", hexId(p.id), "seq", p.seq)
+				s.join(p.seq)
+			}
+		}
+		if p.id != s.id {
+			// only the first stream seen is received
+			continue
+		}
+		lastSeen = time.Now()
+		err = s.push(p)
+		if err != nil {
+			return errors.New("Failed to write stream: " + err.Error())
+		}
+		if s.eof {
+			break
+		}
+	}
+	r.log.Info("Received stream", "stream", hexId(s.id), "size", s.written)
+	if s.lost > 0 {
+		return errors.New("Stream " + strconv.FormatUint(uint64(s.id), 16) + " has " + strconv.Itoa(s.gaps) + " gaps, " + strconv.FormatUint(s.lost, 10) + " packets lost")
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+package godiode
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamOpenerForgedSalt(t *testing.T) {
+	conf := testConfig(t)
+	conf.EncryptionKey = "test key"
+	n := NewMemoryNetwork(Impairment{})
+	l := n.Listen()
+	w, err := newStreamWriter(conf, &senderConn{Transport: n.Dial(), metrics: NewMetrics()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	buff, err := newPacketReader(conf, l, &Logger{out: ioutil.Discard}, NewMetrics()).read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := len(buff)
+
+	o := newStreamOpener(conf, NewMetrics())
+	forged := append([]byte{}, buff[:read]...)
+	forged[5] ^= 0xff
+	if _, err := o.open(forged, len(forged)); err == nil {
+		t.Fatal("opened packet with a forged salt")
+	}
+	if len(o.ciphers) != 0 {
+		t.Fatal("kept the cipher of a forged packet")
+	}
+	p, err := o.open(buff, read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p.data) != "data" || len(o.ciphers) != 1 {
+		t.Fatalf("unexpected packet %+v, %d ciphers", p, len(o.ciphers))
+	}
+}
+
+func TestReceiveStreamTimeout(t *testing.T) {
+	conf := testConfig(t)
+	conf.StreamTimeout = 1
+	n := NewMemoryNetwork(Impairment{})
+	r, err := NewReceiver(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Transport = n.Listen()
+	out := &bytes.Buffer{}
+	done := make(chan error, 1)
+	go func() { done <- r.ReceiveStream(context.Background(), out) }()
+
+	// a stream losing its end
+	s, err := NewSender(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Transport = n.Dial()
+	c, err := s.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := newStreamWriter(conf, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-done:
+		if err == nil || !strings.Contains(err.Error(), "timed out") {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("stream did not time out")
+	}
+	if out.String() != "data" {
+		t.Errorf("received %q", out.String())
+	}
+}
+
+func TestStreamKeepalive(t *testing.T) {
+	conf := testConfig(t)
+	conf.StreamTimeout = 1
+	conf.Sender.HeartbeatInterval = 0
+	n := NewMemoryNetwork(Impairment{})
+	r, err := NewReceiver(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Transport = n.Listen()
+	out := &bytes.Buffer{}
+	done := make(chan error, 1)
+	go func() { done <- r.ReceiveStream(context.Background(), out) }()
+
+	s, err := NewSender(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Transport = n.Dial()
+	in, feed := io.Pipe()
+	sent := make(chan error, 1)
+	go func() { sent <- s.SendStream(context.Background(), in) }()
+	feed.Write([]byte("idle "))
+	// idle for longer than the stream timeout
+	time.Sleep(2500 * time.Millisecond)
+	feed.Write([]byte("stream"))
+	feed.Close()
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("stream not received")
+	}
+	if out.String() != "idle stream" {
+		t.Errorf("received %q", out.String())
+	}
+}
+
+func TestMacSecretRequired(t *testing.T) {
+	conf := testConfig(t)
+	conf.HMACSecret = ""
+	conf.DataMACSize = 16
+	n := NewMemoryNetwork(Impairment{})
+	s, err := NewSender(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Transport = n.Dial()
+	r, err := NewReceiver(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Transport = n.Listen()
+	ctx := context.Background()
+	if err := s.Send(ctx, t.TempDir()); err == nil {
+		t.Error("sent data MACs without a secret")
+	}
+	if err := s.SendStream(ctx, strings.NewReader("data")); err == nil {
+		t.Error("sent stream without a secret")
+	}
+	if err := r.ReceiveStream(ctx, ioutil.Discard); err == nil {
+		t.Error("received stream without a secret")
+	}
+}
+
+func TestStreamClockSkew(t *testing.T) {
+	conf := testConfig(t)
+	conf.Receiver.MaxClockSkew = 1
+	n := NewMemoryNetwork(Impairment{})
+	l := n.Listen()
+	w, err := newStreamWriter(conf, &senderConn{Transport: n.Dial(), metrics: NewMetrics()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	buff, err := newPacketReader(conf, l, &Logger{out: ioutil.Discard}, NewMetrics()).read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1200 * time.Millisecond)
+	if _, err := newStreamOpener(conf, NewMetrics()).open(buff, len(buff)); err == nil {
+		t.Fatal("opened packet older than the max clock skew")
+	}
+}
+
+func TestReceiveStreamReplayRejected(t *testing.T) {
+	conf := testConfig(t)
+	conf.Sender.HeartbeatInterval = 0
+	conf.StateFile = filepath.Join(t.TempDir(), "state.json")
+	receive := func(tr Transport, timeout time.Duration) (string, error) {
+		r, err := NewReceiver(conf)
+		if err != nil {
+			return "", err
+		}
+		r.Transport = tr
+		out := &bytes.Buffer{}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		err = r.ReceiveStream(ctx, out)
+		return out.String(), err
+	}
+
+	n := NewMemoryNetwork(Impairment{})
+	capture := n.Listen()
+	l := n.Listen()
+	received := make(chan string, 1)
+	go func() {
+		out, err := receive(l, 10*time.Second)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- out
+	}()
+	s, err := NewSender(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Transport = n.Dial()
+	if err := s.SendStream(context.Background(), strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	if out := <-received; out != "data" {
+		t.Fatalf("received %q", out)
+	}
+
+	// the recorded stream played back to a restarted receiver
+	packets := [][]byte{}
+	buff := make([]byte, conf.MaxPacketSize)
+	for {
+		capture.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		read, err := capture.ReadPacket(buff)
+		if err != nil {
+			break
+		}
+		packets = append(packets, append([]byte{}, buff[:read]...))
+	}
+	replay := NewMemoryNetwork(Impairment{})
+	l = replay.Listen()
+	w := replay.Dial()
+	for _, p := range packets {
+		w.WritePacket(p)
+	}
+	out, err := receive(l, 1500*time.Millisecond)
+	if err != context.DeadlineExceeded || out != "" {
+		t.Fatalf("replayed stream received: %q, %v", out, err)
+	}
+}
+
+func TestReceiveStreamJoinedLate(t *testing.T) {
+	conf := testConfig(t)
+	conf.Receiver.ReorderWindow = 4
+	n := NewMemoryNetwork(Impairment{})
+	r, err := NewReceiver(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Transport = n.Listen()
+	out := &bytes.Buffer{}
+	done := make(chan error, 1)
+	go func() { done <- r.ReceiveStream(context.Background(), out) }()
+
+	w, err := newStreamWriter(conf, &senderConn{Transport: n.Dial(), metrics: NewMetrics()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first 100 packets were sent before the receiver started
+	w.seq = 100
+	if _, err = w.Write([]byte("joined late")); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("stream not received")
+	}
+	if out.String() != "joined late" {
+		t.Errorf("received %q", out.String())
+	}
+}
@@ -0,0 +1,369 @@
+package godiode
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	TRANSPORT_MULTICAST = "multicast"
+	TRANSPORT_UNICAST   = "unicast"
+)
+
+// Transport carries packets one way from a sender to its receivers. Packets
+// may be lost, reordered or duplicated on the way.
+type Transport interface {
+	// WritePacket sends a single packet
+	WritePacket(pkt []byte) error
+	// ReadPacket blocks until a packet is received into buff and returns its
+	// size. Packets larger than buff are truncated.
+	ReadPacket(buff []byte) (int, error)
+	// SetReadDeadline makes a blocked or later ReadPacket fail with a timeout
+	// error after t, the zero time disables the deadline.
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+type udpTransport struct {
+	c *net.UDPConn
+}
+
+func (t *udpTransport) WritePacket(pkt []byte) error {
+	_, err := t.c.Write(pkt)
+	return err
+}
+
+func (t *udpTransport) ReadPacket(buff []byte) (int, error) {
+	return t.c.Read(buff)
+}
+
+func (t *udpTransport) SetReadDeadline(d time.Time) error {
+	return t.c.SetReadDeadline(d)
+}
+
+func (t *udpTransport) Close() error {
+	return t.c.Close()
+}
+
+func dialUDP(conf *Config, addr string) (Transport, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	var baddr *net.UDPAddr = nil
+	if conf.BindAddr != "" {
+		baddr, err = net.ResolveUDPAddr("udp", conf.BindAddr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c, err := net.DialUDP("udp", baddr, raddr)
+	if err != nil {
+		return nil, err
+	}
+	err = c.SetWriteBuffer(10 * conf.MaxPacketSize)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &udpTransport{c}, nil
+}
+
+// setReadBuffer grows the socket receive buffer, failures are logged to log
+// if set
+func setReadBuffer(conf *Config, log *Logger, c *net.UDPConn) {
+	err := c.SetReadBuffer(300 * conf.MaxPacketSize)
+	if err != nil && log != nil {
+		log.Warn("Failed to set read buffer", "err", err)
+	}
+}
+
+// DialMulticast creates a sender transport to the multicast address
+func DialMulticast(conf *Config) (Transport, error) {
+	return dialUDP(conf, conf.MulticastAddr)
+}
+
+// ListenMulticast creates a receiver transport joining the multicast address
+// on the configured interface
+func ListenMulticast(conf *Config) (Transport, error) {
+	return listenMulticast(conf, conf.Logger)
+}
+
+func listenMulticast(conf *Config, log *Logger) (Transport, error) {
+	maddr, err := net.ResolveUDPAddr("udp", conf.MulticastAddr)
+	if err != nil {
+		return nil, errors.New("Failed to resolve multicast address: " + err.Error())
+	}
+	var nic *net.Interface
+	if conf.NIC != "" {
+		nic, err = net.InterfaceByName(conf.NIC)
+		if err != nil {
+			return nil, errors.New("Failed to resolve nic: " + err.Error())
+		}
+	}
+	c, err := net.ListenMulticastUDP("udp", nic, maddr)
+	if err != nil {
+		return nil, errors.New("Failed to join multicast address: " + err.Error())
+	}
+	setReadBuffer(conf, log, c)
+	return &udpTransport{c}, nil
+}
+
+// DialUnicast creates a sender transport to the unicast address of a single
+// receiver
+func DialUnicast(conf *Config) (Transport, error) {
+	return dialUDP(conf, conf.UnicastAddr)
+}
+
+// ListenUnicast creates a receiver transport listening on the unicast address
+func ListenUnicast(conf *Config) (Transport, error) {
+	return listenUnicast(conf, conf.Logger)
+}
+
+func listenUnicast(conf *Config, log *Logger) (Transport, error) {
+	addr, err := net.ResolveUDPAddr("udp", conf.UnicastAddr)
+	if err != nil {
+		return nil, errors.New("Failed to resolve unicast address: " + err.Error())
+	}
+	c, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, errors.New("Failed to listen on unicast address: " + err.Error())
+	}
+	setReadBuffer(conf, log, c)
+	return &udpTransport{c}, nil
+}
+
+func dialTransport(conf *Config) (Transport, error) {
+	switch conf.Transport {
+	case "", TRANSPORT_MULTICAST:
+		return DialMulticast(conf)
+	case TRANSPORT_UNICAST:
+		return DialUnicast(conf)
+	}
+	return nil, errors.New("Invalid transport " + conf.Transport)
+}
+
+func listenTransport(conf *Config, log *Logger) (Transport, error) {
+	switch conf.Transport {
+	case "", TRANSPORT_MULTICAST:
+		return listenMulticast(conf, log)
+	case TRANSPORT_UNICAST:
+		return listenUnicast(conf, log)
+	}
+	return nil, errors.New("Invalid transport " + conf.Transport)
+}
+
+// borrowedTransport is a transport owned by the caller, which is not closed
+// when the sender or receiver is done with it
+type borrowedTransport struct {
+	Transport
+}
+
+func (t borrowedTransport) Close() error {
+	return nil
+}
+
+// Impairment configures the faults injected by a MemoryNetwork. All values
+// are probabilities per packet.
+type Impairment struct {
+	Loss float64
+	// Reorder delays a packet until after the next one, or by
+	// MEMORY_REORDER_DELAY if no packet follows
+	Reorder   float64
+	Duplicate float64
+	// BitFlip flips a random bit of a packet
+	BitFlip float64
+	// Seed of the random source, the same seed and packets give the same faults
+	Seed int64
+}
+
+// packets queued per listening memory transport, more are dropped
+const MEMORY_QUEUE_PACKETS = 1024
+
+// max delay of a reordered packet
+const MEMORY_REORDER_DELAY = 20 * time.Millisecond
+
+// MemoryNetwork is an in-process multicast network, delivering every packet
+// written to any of its transports to all its listening transports. Like a
+// diode it never blocks a writer, packets for a listener with a full queue
+// are lost.
+type MemoryNetwork struct {
+	lock      sync.Mutex
+	imp       Impairment
+	rnd       *rand.Rand
+	held      []byte
+	holds     int
+	listeners []*memoryTransport
+	lost      int
+}
+
+// NewMemoryNetwork creates a network impairing packets as configured by imp
+func NewMemoryNetwork(imp Impairment) *MemoryNetwork {
+	return &MemoryNetwork{imp: imp, rnd: rand.New(rand.NewSource(imp.Seed))}
+}
+
+// Lost returns the number of packets lost, by impairment or by a full
+// listener queue
+func (n *MemoryNetwork) Lost() int {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.lost
+}
+
+// Dial creates a transport for sending
+func (n *MemoryNetwork) Dial() Transport {
+	return n.newTransport(nil)
+}
+
+// Listen creates a transport receiving all packets written after it was
+// created
+func (n *MemoryNetwork) Listen() Transport {
+	t := n.newTransport(make(chan []byte, MEMORY_QUEUE_PACKETS))
+	n.lock.Lock()
+	n.listeners = append(n.listeners, t)
+	n.lock.Unlock()
+	return t
+}
+
+func (n *MemoryNetwork) newTransport(c chan []byte) *memoryTransport {
+	return &memoryTransport{n: n, c: c, closed: make(chan struct{}), wake: make(chan struct{})}
+}
+
+func (n *MemoryNetwork) write(pkt []byte) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.rnd.Float64() < n.imp.Loss {
+		n.lost++
+		return
+	}
+	p := append([]byte{}, pkt...)
+	if len(p) > 0 && n.rnd.Float64() < n.imp.BitFlip {
+		bit := n.rnd.Intn(len(p) * 8)
+		p[bit/8] ^= 1 << (bit % 8)
+	}
+	if n.held == nil && n.rnd.Float64() < n.imp.Reorder {
+		n.held = p
+		n.holds++
+		hold := n.holds
+		time.AfterFunc(MEMORY_REORDER_DELAY, func() { n.release(hold) })
+		return
+	}
+	n.deliver(p)
+	if n.rnd.Float64() < n.imp.Duplicate {
+		n.deliver(p)
+	}
+	if n.held != nil {
+		n.deliver(n.held)
+		n.held = nil
+	}
+}
+
+// release delivers the held packet if no packet was written after it
+func (n *MemoryNetwork) release(hold int) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.held != nil && n.holds == hold {
+		n.deliver(n.held)
+		n.held = nil
+	}
+}
+
+func (n *MemoryNetwork) deliver(p []byte) {
+	for _, l := range n.listeners {
+		select {
+		case l.c <- p:
+		default:
+			n.lost++
+		}
+	}
+}
+
+type memoryTransport struct {
+	n         *MemoryNetwork
+	c         chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	lock      sync.Mutex
+	deadline  time.Time
+	wake      chan struct{}
+}
+
+func (t *memoryTransport) WritePacket(pkt []byte) error {
+	select {
+	case <-t.closed:
+		return net.ErrClosed
+	default:
+	}
+	t.n.write(pkt)
+	return nil
+}
+
+func (t *memoryTransport) ReadPacket(buff []byte) (int, error) {
+	for {
+		t.lock.Lock()
+		deadline := t.deadline
+		wake := t.wake
+		t.lock.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+		var p []byte
+		var err error
+		woken := false
+		select {
+		case p = <-t.c:
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-t.closed:
+			err = net.ErrClosed
+		case <-wake:
+			// deadline changed
+			woken = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if !woken {
+			if err != nil {
+				return 0, err
+			}
+			return copy(buff, p), nil
+		}
+	}
+}
+
+func (t *memoryTransport) SetReadDeadline(d time.Time) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.deadline = d
+	close(t.wake)
+	t.wake = make(chan struct{})
+	return nil
+}
+
+func (t *memoryTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		if t.c == nil {
+			return
+		}
+		n := t.n
+		n.lock.Lock()
+		defer n.lock.Unlock()
+		for i, l := range n.listeners {
+			if l == t {
+				n.listeners = append(n.listeners[:i], n.listeners[i+1:]...)
+				break
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,175 @@
+package godiode
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"time"
+)
+
+type pendingChange struct {
+	record FileRecord
+	since  time.Time
+}
+
+/**
+ * Watch mode
+ *
+ * Keeps scanning dir for new and modified files, triggered by file system
+ * notifications where supported and by polling otherwise. A changed file is
+ * sent once it has been left unchanged for the settle delay, in a new
+ * manifest session. The manifest lists the settled files along with the last
+ * sent version of all other files, so a receiver running with --delete
+ * mirrors the directory without removing files still being changed, but only
+ * the settled files are transmitted.
+ */
+func (s *Sender) Watch(ctx context.Context, dir string) error {
+	conf := s.conf
+	dir = path.Clean(dir)
+	finfo, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !finfo.IsDir() {
+		return errors.New("Watch dir is not a directory")
+	}
+	if conf.Sender.PollInterval < 1 {
+		return errors.New("Invalid poll interval")
+	}
+	err = checkSpoolConfig(conf, dir)
+	if err != nil {
+		return err
+	}
+
+	sig, err := newSigner(conf)
+	if err != nil {
+		return err
+	}
+
+	c, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// changed files not sent yet, reported in heartbeats
+	var queued counter
+	stopHeartbeats, err := s.startHeartbeats(c, queued.get)
+	if err != nil {
+		return err
+	}
+	defer stopHeartbeats()
+
+	var events <-chan struct{}
+	notifier, err := newDirNotifier(dir)
+	if err != nil {
+		s.log.Warn("File notifications unavailable, falling back to polling", "err", err)
+	} else {
+		defer notifier.close()
+		events = notifier.C
+	}
+
+	settle := time.Duration(conf.Sender.SettleDelay) * time.Second
+	poll := time.NewTicker(time.Duration(conf.Sender.PollInterval) * time.Second)
+	defer poll.Stop()
+	var settled <-chan time.Time
+
+	sent := map[string]FileRecord{}
+	pending := map[string]pendingChange{}
+	for {
+		manifest, err := generateManifest(dir)
+		if err != nil {
+			s.log.Error("Failed to scan dir", "path", dir, "err", err)
+		} else {
+			if notifier != nil {
+				notifier.addWatches()
+			}
+
+			now := time.Now()
+			ready := make([]int, 0)
+			present := map[string]bool{}
+			for i, f := range manifest.files {
+				present[f.path] = true
+				if prev, exists := sent[f.path]; exists && prev == f {
+					delete(pending, f.path)
+					continue
+				}
+				p, exists := pending[f.path]
+				if !exists || p.record != f {
+					pending[f.path] = pendingChange{f, now}
+					continue
+				}
+				if now.Sub(p.since) >= settle {
+					ready = append(ready, i)
+				}
+			}
+			for p := range sent {
+				if !present[p] {
+					delete(sent, p)
+				}
+			}
+			for p := range pending {
+				if !present[p] {
+					delete(pending, p)
+				}
+			}
+
+			if len(ready) > 0 {
+				queued.set(uint64(len(pending)))
+				s.log.Info("Sending changed files", "files", len(ready))
+				session, ready := watchManifest(manifest, ready, sent)
+				done, err := s.sendSession(ctx, c, sig, dir, session, ready)
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				if err != nil {
+					s.log.Error("Failed to send changed files", "err", err)
+				}
+				// failed files are retried once settled again
+				for _, i := range ready {
+					pending[session.files[i].path] = pendingChange{session.files[i], time.Now()}
+				}
+				for _, i := range done {
+					sent[session.files[i].path] = session.files[i]
+					delete(pending, session.files[i].path)
+				}
+			}
+		}
+
+		queued.set(uint64(len(pending)))
+		settled = nil
+		if len(pending) > 0 {
+			settled = time.After(settle)
+		}
+		select {
+		case <-events:
+		case <-poll.C:
+		case <-settled:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// watchManifest returns the manifest of a watch session and the indexes of the
+// ready files in it. Files not settled yet are listed as last sent, or left
+// out if never sent, so a receiver running with --delete keeps its copy until
+// the new one arrives.
+func watchManifest(scanned *Manifest, ready []int, sent map[string]FileRecord) (*Manifest, []int) {
+	isReady := map[int]bool{}
+	for _, i := range ready {
+		isReady[i] = true
+	}
+	manifest := &Manifest{dirs: scanned.dirs, files: make([]FileRecord, 0, len(scanned.files))}
+	indexes := make([]int, 0, len(ready))
+	for i, f := range scanned.files {
+		if isReady[i] {
+			indexes = append(indexes, len(manifest.files))
+			manifest.files = append(manifest.files, f)
+		} else if prev, exists := sent[f.path]; exists {
+			manifest.files = append(manifest.files, prev)
+		}
+	}
+	return manifest, indexes
+}
@@ -0,0 +1,70 @@
+//go:build linux
+// +build linux
+
+package godiode
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE
+
+// dirNotifier signals C on any inotify event in the watched tree
+type dirNotifier struct {
+	fd   int
+	file *os.File
+	dir  string
+	C    chan struct{}
+	done sync.WaitGroup
+}
+
+func newDirNotifier(dir string) (*dirNotifier, error) {
+	// non-blocking, so closing the file wakes up a pending read
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	n := &dirNotifier{fd: fd, file: os.NewFile(uintptr(fd), "inotify"), dir: dir, C: make(chan struct{}, 1)}
+	n.addWatches()
+	n.done.Add(1)
+	go n.run()
+	return n, nil
+}
+
+// close stops the notifier and releases the inotify instance
+func (n *dirNotifier) close() {
+	n.file.Close()
+	n.done.Wait()
+}
+
+// addWatches watches all dirs in the tree, re-adding existing ones is a no-op
+func (n *dirNotifier) addWatches() {
+	filepath.WalkDir(n.dir, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			syscall.InotifyAddWatch(n.fd, p, inotifyMask)
+		}
+		return nil
+	})
+}
+
+func (n *dirNotifier) run() {
+	defer n.done.Done()
+	buff := make([]byte, 64*1024)
+	for {
+		l, err := n.file.Read(buff)
+		if err != nil {
+			return
+		}
+		if l > 0 {
+			select {
+			case n.C <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
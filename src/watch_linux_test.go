@@ -0,0 +1,30 @@
+//go:build linux
+// +build linux
+
+package godiode
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDirNotifierClose(t *testing.T) {
+	n, err := newDirNotifier(t.TempDir())
+	if err != nil {
+		t.Skip("no inotify: " + err.Error())
+	}
+	closed := make(chan struct{})
+	go func() {
+		n.close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("notifier not stopped")
+	}
+	if _, err := syscall.InotifyAddWatch(n.fd, n.dir, inotifyMask); err != syscall.EBADF {
+		t.Errorf("inotify fd still open: %v", err)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package godiode
+
+import "errors"
+
+type dirNotifier struct {
+	C chan struct{}
+}
+
+func newDirNotifier(dir string) (*dirNotifier, error) {
+	return nil, errors.New("not supported on this platform")
+}
+
+func (n *dirNotifier) addWatches() {
+}
+
+func (n *dirNotifier) close() {
+}